@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// Retry-After (seconds) sent when the admission queue is full
+const queueRetryAfter = 1
+
+// AdmissionQueue bounds the number of checks running at once. Up to workers
+// checks run concurrently, up to queueSize more wait for a free slot and any
+// further request is turned away instead of piling up outbound dials.
+type AdmissionQueue struct {
+	slots     chan struct{}
+	queueSize int64
+	queued    atomic.Int64
+}
+
+func NewAdmissionQueue(workers, queueSize int) *AdmissionQueue {
+	return &AdmissionQueue{
+		slots:     make(chan struct{}, workers),
+		queueSize: int64(queueSize),
+	}
+}
+
+// Acquire waits for a free slot. It returns false without waiting when the
+// queue is full, and false when ctx ends while queued.
+func (q *AdmissionQueue) Acquire(ctx context.Context) bool {
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if q.queued.Add(1) > q.queueSize {
+		q.queued.Add(-1)
+		return false
+	}
+	defer q.queued.Add(-1)
+
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (q *AdmissionQueue) Release() {
+	<-q.slots
+}
+
+// admit takes an admission slot for r and counts it as active. It returns a
+// release func, or nil after setting Retry-After when the request must be
+// rejected. Without a configured queue every request is admitted.
+func admit(w http.ResponseWriter, r *http.Request) func() {
+	if admission != nil && !admission.Acquire(r.Context()) {
+		w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter))
+		return nil
+	}
+	activeChecks.Add(1)
+	return func() {
+		activeChecks.Add(-1)
+		if admission != nil {
+			admission.Release()
+		}
+	}
+}
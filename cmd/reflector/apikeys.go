@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// APIKey describes a single API key loaded from the keys file
+type APIKey struct {
+	Key          string `json:"key"`
+	Name         string `json:"name"`
+	DailyQuota   int    `json:"daily_quota"`    // 0 = unlimited
+	AllowedPorts []int  `json:"allowed_ports"`  // overrides REFLECTOR_ALLOWED_PORTS
+	Admin        bool   `json:"admin"`          // may use /admin endpoints
+	AllowAnyPort bool   `json:"allow_any_port"` // admin only: ignore the allowlists
+
+	quota        *rate.Limiter
+	allowedPorts map[int]bool
+}
+
+// APIKeyStore holds all configured API keys
+type APIKeyStore struct {
+	keys map[string]*APIKey
+}
+
+type apiKeysFile struct {
+	Keys []*APIKey `json:"keys"`
+}
+
+// LoadAPIKeys reads API keys from a JSON file of the form
+// {"keys": [{"key": "...", "name": "...", "daily_quota": 1000}]}.
+// An empty path yields an empty store.
+func LoadAPIKeys(path string) (*APIKeyStore, error) {
+	store := &APIKeyStore{keys: make(map[string]*APIKey)}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file apiKeysFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	for i, key := range file.Keys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("key #%d: missing key", i+1)
+		}
+		if _, exists := store.keys[key.Key]; exists {
+			return nil, fmt.Errorf("key #%d (%s): duplicate key", i+1, key.Name)
+		}
+		if key.DailyQuota < 0 {
+			return nil, fmt.Errorf("key #%d (%s): daily_quota must not be negative", i+1, key.Name)
+		}
+		if key.AllowedPorts != nil {
+			key.allowedPorts = make(map[int]bool, len(key.AllowedPorts))
+			for _, port := range key.AllowedPorts {
+				if port < 1 || port > 65535 {
+					return nil, fmt.Errorf("key #%d (%s): invalid allowed port %d", i+1, key.Name, port)
+				}
+				key.allowedPorts[port] = true
+			}
+		}
+		if key.AllowAnyPort && !key.Admin {
+			return nil, fmt.Errorf("key #%d (%s): allow_any_port requires admin", i+1, key.Name)
+		}
+		if key.DailyQuota > 0 {
+			// Token bucket refilled over 24h with the whole quota as burst,
+			// which approximates a rolling daily window.
+			key.quota = rate.NewLimiter(rate.Every(24*time.Hour/time.Duration(key.DailyQuota)), key.DailyQuota)
+		}
+		store.keys[key.Key] = key
+	}
+
+	return store, nil
+}
+
+// Lookup returns the API key matching key
+func (s *APIKeyStore) Lookup(key string) (*APIKey, bool) {
+	k, ok := s.keys[key]
+	return k, ok
+}
+
+// Len returns the number of configured keys
+func (s *APIKeyStore) Len() int {
+	return len(s.keys)
+}
+
+// ConsumeQuota takes one request from the key's daily quota and returns
+// whether it was allowed along with the remaining quota.
+func (k *APIKey) ConsumeQuota() (bool, int) {
+	if k.quota == nil {
+		return true, -1
+	}
+	allowed := k.quota.Allow()
+	return allowed, int(k.quota.Tokens())
+}
+
+// allowedPortsFor returns the port allowlist that applies to key, falling
+// back to the global allowlist for anonymous requests and keys without one
+func allowedPortsFor(key *APIKey) map[int]bool {
+	if key != nil && key.allowedPorts != nil {
+		return key.allowedPorts
+	}
+	return config.AllowedPorts
+}
+
+// portAllowed reports whether key may check port. Admin keys with
+// allow_any_port may check any valid port; the private IP protection still
+// applies to them.
+func portAllowed(key *APIKey, port int) bool {
+	if port < 1 || port > 65535 {
+		return false
+	}
+	if key != nil && key.Admin && key.AllowAnyPort {
+		return true
+	}
+	return allowedPortsFor(key)[port]
+}
+
+// auditPortBypass records ports that were only allowed through
+// allow_any_port, so bypasses stand out from regular checks
+func auditPortBypass(key *APIKey, clientIP string, ports []int) {
+	if key == nil || !key.AllowAnyPort {
+		return
+	}
+	allowed := allowedPortsFor(key)
+	var bypassed []int
+	for _, port := range ports {
+		if !allowed[port] {
+			bypassed = append(bypassed, port)
+		}
+	}
+	if len(bypassed) == 0 {
+		return
+	}
+	logger.LogError("audit", "port allowlist bypassed", map[string]interface{}{
+		"key":   key.Name,
+		"ip":    anonymizeIP(clientIP),
+		"ports": bypassed,
+	})
+}
+
+// getAPIKey extracts the API key from the X-API-Key header or api_key param
+func getAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// authenticate resolves the request's API key. It returns nil without error
+// for anonymous requests and an error for unknown keys.
+func authenticate(r *http.Request) (*APIKey, error) {
+	raw := getAPIKey(r)
+	if raw == "" {
+		return nil, nil
+	}
+	key, ok := apiKeys.Lookup(raw)
+	if !ok {
+		return nil, fmt.Errorf("unknown API key")
+	}
+	return key, nil
+}
+
+// checkQuota consumes quota for key and sets the quota headers. It returns
+// false when the daily quota is exhausted.
+func checkQuota(w http.ResponseWriter, key *APIKey) bool {
+	if key == nil {
+		return true
+	}
+	allowed, remaining := key.ConsumeQuota()
+	if remaining >= 0 {
+		w.Header().Set("X-Quota-Limit", fmt.Sprint(key.DailyQuota))
+		w.Header().Set("X-Quota-Remaining", fmt.Sprint(remaining))
+	}
+	return allowed
+}
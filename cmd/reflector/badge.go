@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Badge colors, matching the shields.io palette
+const (
+	badgeColorLabel = "#555"
+	badgeColorUp    = "#4c1"
+	badgeColorDown  = "#e05d44"
+	badgeColorError = "#9f9f9f"
+)
+
+// badgeCache holds /badge answers for REFLECTOR_BADGE_CACHE_TTL, so a
+// status page refreshing the image does not dial on every view
+var badgeCache *TTLCache[bool]
+
+// badgeTextWidth approximates the width of s in 11px Verdana, the font
+// shields.io-style badges are set in
+func badgeTextWidth(s string) int {
+	return len(s)*7 + 10
+}
+
+// renderBadge draws a flat two-part badge with label on the left and
+// message on a background of color on the right
+func renderBadge(label, message, color string) string {
+	lw, mw := badgeTextWidth(label), badgeTextWidth(message)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">`+
+		`<title>%[4]s: %[5]s</title>`+
+		`<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`+
+		`<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>`+
+		`<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="%[7]s"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%[8]d" y="14">%[4]s</text><text x="%[9]d" y="14">%[5]s</text></g></svg>`,
+		lw+mw, lw, mw, label, message, color, badgeColorLabel, lw/2, lw+mw/2)
+}
+
+// handleBadge answers like /simple, but with an SVG badge for embedding in
+// READMEs and status pages. Failures are drawn as a grey "error" badge and
+// keep their HTTP status.
+func handleBadge(w http.ResponseWriter, r *http.Request) {
+	port, reachable, status := runSimpleCheck(w, r, badgeCache)
+
+	label := "port " + strconv.Itoa(port)
+	message, color := "unreachable", badgeColorDown
+	switch {
+	case status != http.StatusOK:
+		message, color = "error", badgeColorError
+	case reachable:
+		message, color = "reachable", badgeColorUp
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	// The badge depends on the caller's IP, so shared caches must not keep it
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(config.BadgeCacheTTL.Seconds())))
+	w.WriteHeader(status)
+	fmt.Fprint(w, renderBadge(label, message, color))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// TTLCache is a small in-memory cache whose entries expire after a fixed TTL.
+// With maxEntries > 0 it never holds more than that many entries.
+type TTLCache[V any] struct {
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]cacheEntry[V]
+	mu         sync.Mutex
+}
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func NewTTLCache[V any](ttl time.Duration, maxEntries int) *TTLCache[V] {
+	return &TTLCache[V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]cacheEntry[V]),
+	}
+}
+
+// Get returns the value stored for key unless it has expired
+func (c *TTLCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Set stores value for key for the cache's TTL. When the cache is full, the
+// entry closest to expiring makes room.
+func (c *TTLCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[key]; !exists && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		var oldestKey string
+		var oldest time.Time
+		for k, entry := range c.entries {
+			if oldestKey == "" || entry.expires.Before(oldest) {
+				oldestKey, oldest = k, entry.expires
+			}
+		}
+		delete(c.entries, oldestKey)
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+// Cleanup removes expired entries
+func (c *TTLCache[V]) Cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
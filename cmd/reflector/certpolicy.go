@@ -0,0 +1,56 @@
+package main
+
+import "crypto/x509"
+
+// Certificate policy OIDs that reveal the validation level: the CA/Browser
+// Forum reserved policies, and the EV policies of CAs that predate them and
+// are still commonly the only EV marker in a certificate
+var policyValidationLevels = map[string]string{
+	"2.23.140.1.1":   "EV",
+	"2.23.140.1.2.1": "DV",
+	"2.23.140.1.2.2": "OV",
+	"2.23.140.1.2.3": "IV",
+
+	"2.16.840.1.114412.2.1":        "EV", // DigiCert
+	"1.3.6.1.4.1.6449.1.2.1.5.1":   "EV", // Sectigo
+	"1.3.6.1.4.1.4146.1.1":         "EV", // GlobalSign
+	"2.16.840.1.114028.10.1.2":     "EV", // Entrust
+	"2.16.840.1.114413.1.7.23.3":   "EV", // GoDaddy
+	"2.16.840.1.114414.1.7.23.3":   "EV", // Starfield
+	"1.3.6.1.4.1.14370.1.6":        "EV", // GeoTrust
+	"2.16.840.1.113733.1.7.23.6":   "EV", // Symantec/VeriSign
+	"1.3.6.1.4.1.34697.2.1":        "EV", // AffirmTrust
+	"2.16.756.1.89.1.2.1.1":        "EV", // SwissSign
+	"1.3.6.1.4.1.8024.0.2.100.1.2": "EV", // QuoVadis
+}
+
+// Levels in increasing order of assurance
+var validationRank = map[string]int{"DV": 1, "IV": 2, "OV": 3, "EV": 4}
+
+// certPolicies returns the certificate policy OIDs of cert in dotted form
+func certPolicies(cert *x509.Certificate) []string {
+	var oids []string
+	for _, oid := range cert.Policies {
+		oids = append(oids, oid.String())
+	}
+	return oids
+}
+
+// validationLevel is a best-effort DV/IV/OV/EV classification of cert: the
+// highest level named by a known policy OID, or, without one, OV if the
+// subject carries an organization and DV otherwise
+func validationLevel(cert *x509.Certificate, policies []string) string {
+	level := ""
+	for _, oid := range policies {
+		if l, ok := policyValidationLevels[oid]; ok && validationRank[l] > validationRank[level] {
+			level = l
+		}
+	}
+	if level != "" {
+		return level
+	}
+	if len(cert.Subject.Organization) > 0 {
+		return "OV"
+	}
+	return "DV"
+}
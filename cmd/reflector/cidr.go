@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+// Largest block cidr may name, in host bits: 8 addresses, i.e. a /29 for
+// IPv4 and a /125 for IPv6
+const maxCIDRHostBits = 3
+
+// parseCheckCIDR validates the cidr parameter: a block of at most
+// 1<<maxCIDRHostBits addresses that contains the caller's IP, which shows the
+// caller has at least one address in it
+func parseCheckCIDR(v string, clientIP string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(v)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("cidr is not a valid CIDR block")
+	}
+	prefix = prefix.Masked()
+	client, err := netip.ParseAddr(clientIP)
+	if err != nil || !prefix.Contains(client.Unmap()) {
+		// The address is left out, so the message never reveals a redacted IP
+		return netip.Prefix{}, fmt.Errorf("cidr must contain your IP address")
+	}
+	if prefix.Addr().BitLen()-prefix.Bits() > maxCIDRHostBits {
+		return netip.Prefix{}, fmt.Errorf("cidr must not cover more than %d addresses", 1<<maxCIDRHostBits)
+	}
+	return prefix, nil
+}
+
+// cidrAddresses lists the addresses of prefix to check. The network and
+// broadcast addresses of IPv4 blocks are left out, as are any non-public
+// addresses.
+func cidrAddresses(prefix netip.Prefix) []netip.Addr {
+	var addrs []netip.Addr
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		addrs = append(addrs, addr)
+	}
+	if prefix.Addr().Is4() && prefix.Bits() < 31 {
+		addrs = addrs[1 : len(addrs)-1]
+	}
+	public := addrs[:0]
+	for _, addr := range addrs {
+		if !isPrivateIP(net.IP(addr.AsSlice())) {
+			public = append(public, addr)
+		}
+	}
+	return public
+}
+
+// checkCIDR checks ports on every address of prefix. Results are keyed by
+// address and then by port, like the top-level results.
+func checkCIDR(ctx context.Context, prefix netip.Prefix, ports []int) map[string]map[string]PortResult {
+	addrs := cidrAddresses(prefix)
+	results := make(map[string]map[string]PortResult, len(addrs))
+	for _, addr := range addrs {
+		results[addr.String()] = make(map[string]PortResult, len(ports))
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		dialSlots chan struct{}
+	)
+	if config.MaxDialsPerCheck > 0 {
+		dialSlots = make(chan struct{}, config.MaxDialsPerCheck)
+	}
+	for _, addr := range addrs {
+		for _, port := range ports {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if dialSlots != nil {
+					dialSlots <- struct{}{}
+					defer func() { <-dialSlots }()
+				}
+
+				var result PortResult
+				if ctx.Err() != nil {
+					result.Error = "check_deadline_exceeded"
+				} else {
+					reachable, latency, err := checkPort(ctx, addr.String(), port)
+					result.Reachable = reachable
+					result.LatencyMs = latency
+					if err != nil {
+						result.Error = errorCode("connection_failed", err)
+					}
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				results[addr.String()][strconv.Itoa(port)] = result
+			}()
+		}
+	}
+	wg.Wait()
+	return results
+}
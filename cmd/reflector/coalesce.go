@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Identical checks in flight at the same time (e.g. many clients behind one
+// NAT polling in sync) share a single execution
+var checkGroup singleflight.Group
+
+// checkOutcome is the shared result of one execution of the port checks.
+// It is read by every coalesced request and must not be modified.
+type checkOutcome struct {
+	results      map[string]PortResult
+	resultsBool  map[string]bool
+	portsChecked int
+	portsSkipped int
+}
+
+// Query parameters that only affect how the result is presented
+var presentationParams = []string{"api_key", "pretty", "format", "results"}
+
+// coalesceKey identifies checks that would produce the same outcome: same
+// client IP, same options, same deadline header and same challenge scheme,
+// which defaults to the scheme of the request when not given. The dialed
+// ports and the API key are part of it as well, since keys differ in which
+// ports they may check.
+func coalesceKey(clientIP, challengeScheme string, apiKey *APIKey, ports []int, r *http.Request) string {
+	query := url.Values{}
+	for k, v := range r.URL.Query() {
+		query[k] = v
+	}
+	for _, param := range presentationParams {
+		query.Del(param)
+	}
+	sorted := slices.Clone(ports)
+	slices.Sort(sorted)
+	portList := make([]string, len(sorted))
+	for i, port := range sorted {
+		portList[i] = strconv.Itoa(port)
+	}
+	// The key itself only identifies the caller here and is never logged
+	keyID := ""
+	if apiKey != nil {
+		keyID = apiKey.Key
+	}
+	// Encode sorts by key, so parameter order does not matter
+	return strings.Join([]string{
+		clientIP + "?" + query.Encode(),
+		r.Header.Get("X-Check-Timeout"),
+		challengeScheme,
+		strings.Join(portList, ","),
+		keyID,
+	}, "#")
+}
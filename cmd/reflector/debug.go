@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Headers whose values are never echoed back
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+}
+
+type DebugEchoResponse struct {
+	Success      bool                `json:"success"`
+	ClientIP     string              `json:"client_ip"`
+	IPVersion    int                 `json:"ip_version,omitempty"`
+	ClientIPFrom string              `json:"client_ip_from,omitempty"` // x-forwarded-for, x-real-ip or remote_addr
+	RemoteAddr   string              `json:"remote_addr,omitempty"`
+	TrustedProxy bool                `json:"trusted_proxy"` // remote_addr is a trusted proxy
+	Headers      map[string][]string `json:"headers,omitempty"`
+	Timestamp    string              `json:"timestamp"`
+	Error        string              `json:"error,omitempty"`
+	Message      string              `json:"message,omitempty"`
+}
+
+// handleDebugEcho shows how the reflector sees the request: the resolved
+// client IP, where it came from and all received headers.
+func handleDebugEcho(w http.ResponseWriter, r *http.Request) {
+	clientIP, source := resolveClientIP(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	reject := func(status int, errCode, message string) {
+		w.WriteHeader(status)
+		encodeResponse(json.NewEncoder(w), DebugEchoResponse{
+			Success:   false,
+			ClientIP:  clientIP,
+			Timestamp: formatTimestamp(time.Now()),
+			Error:     errCode,
+			Message:   message,
+		})
+	}
+
+	if !rateLimiter.GetLimiter(clientIP).Allow() {
+		reject(http.StatusTooManyRequests, "rate_limit_exceeded", "Too many requests. Please try again later.")
+		return
+	}
+
+	key, err := authenticate(r)
+	if err != nil || (config.DebugEchoRequireKey && key == nil) {
+		reject(http.StatusUnauthorized, "unauthorized", "A valid API key is required")
+		return
+	}
+
+	headers := make(map[string][]string, len(r.Header))
+	for name, values := range r.Header {
+		if secretHeaders[name] {
+			values = []string{"[redacted]"}
+		}
+		headers[name] = values
+	}
+
+	resp := DebugEchoResponse{
+		Success:      true,
+		ClientIP:     clientIP,
+		ClientIPFrom: source,
+		RemoteAddr:   r.RemoteAddr,
+		Headers:      headers,
+		Timestamp:    formatTimestamp(time.Now()),
+	}
+	if ip := net.ParseIP(clientIP); ip != nil {
+		resp.IPVersion = getIPVersion(ip)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if peer := net.ParseIP(host); peer != nil {
+			resp.TrustedProxy = isTrustedProxy(peer)
+		}
+	}
+
+	encodeResponse(json.NewEncoder(w), resp)
+}
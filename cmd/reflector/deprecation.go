@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+)
+
+// deprecatedParams lists /check parameters that still work but are going
+// away, with what to use instead, e.g. "old_name": "use new_name". Requests
+// using them get a warning in the response until the parameter is removed.
+var deprecatedParams = map[string]string{}
+
+// deprecatedDefault is a default that will change. applies reports whether
+// a request relies on it, typically by not setting the parameter at all.
+type deprecatedDefault struct {
+	applies func(query url.Values) bool
+	warning string
+}
+
+var deprecatedDefaults []deprecatedDefault
+
+// deprecationWarnings returns the warnings for the deprecated parameters and
+// changing defaults a request uses, sorted so responses are stable
+func deprecationWarnings(query url.Values) []string {
+	var warnings []string
+	for param, advice := range deprecatedParams {
+		if query.Has(param) {
+			warnings = append(warnings, param+" is deprecated: "+advice)
+		}
+	}
+	for _, d := range deprecatedDefaults {
+		if d.applies(query) {
+			warnings = append(warnings, d.warning)
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
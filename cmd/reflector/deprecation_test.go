@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeprecationWarnings(t *testing.T) {
+	setupTest(t)
+	captureAccessLog(t)
+	config.Timeout = 200 * time.Millisecond
+
+	savedParams, savedDefaults := deprecatedParams, deprecatedDefaults
+	t.Cleanup(func() { deprecatedParams, deprecatedDefaults = savedParams, savedDefaults })
+	deprecatedParams = map[string]string{"old_param": "use new_param"}
+	deprecatedDefaults = []deprecatedDefault{{
+		applies: func(query url.Values) bool { return !query.Has("new_default") },
+		warning: "the default of new_default changes",
+	}}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       []string
+	}{
+		{"none", "ports=80&tls_analyze=false&new_default=1", http.StatusOK, nil},
+		{"param and default", "ports=80&tls_analyze=false&old_param=1", http.StatusOK,
+			[]string{"old_param is deprecated: use new_param", "the default of new_default changes"}},
+		{"rejected request", "ports=abc&old_param=1&new_default=1", http.StatusBadRequest,
+			[]string{"old_param is deprecated: use new_param"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/check?"+tt.query, nil)
+			r.RemoteAddr = "192.0.2.20:40000"
+			w := httptest.NewRecorder()
+			handleCheck(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var resp CheckResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Warnings, tt.want) {
+				t.Errorf("warnings = %q, want %q", resp.Warnings, tt.want)
+			}
+		})
+	}
+}
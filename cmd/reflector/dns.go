@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PTRResult is the reverse DNS lookup of the client IP
+type PTRResult struct {
+	Names           []string `json:"names,omitempty"`
+	DNSSECValidated bool     `json:"dnssec_validated"` // resolver set the AD bit
+	Error           string   `json:"error,omitempty"`
+}
+
+// dnsServer returns the DNS server queried directly for lookups that need
+// DNSSEC information: REFLECTOR_DNS_RESOLVER or the first system nameserver
+func dnsServer() (string, bool) {
+	if config.DNSResolver != "" {
+		return withDNSPort(config.DNSResolver), true
+	}
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(conf.Servers) == 0 {
+		return "", false
+	}
+	return net.JoinHostPort(conf.Servers[0], conf.Port), true
+}
+
+// withDNSPort adds the default DNS port to address if it has none
+func withDNSPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, "53")
+	}
+	return address
+}
+
+// exchangeDNS sends msg to server over UDP and repeats it over TCP if the
+// answer was truncated, since a truncated answer may lack records
+func exchangeDNS(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, error) {
+	client := &dns.Client{Timeout: config.Timeout}
+	reply, _, err := client.ExchangeContext(ctx, msg, server)
+	if err != nil || !reply.Truncated {
+		return reply, err
+	}
+	client.Net = "tcp"
+	reply, _, err = client.ExchangeContext(ctx, msg, server)
+	return reply, err
+}
+
+// lookupPTR resolves the PTR records of ip with the DO bit set, so a
+// validating resolver reports whether the answer was DNSSEC-validated
+func lookupPTR(ctx context.Context, ip string) *PTRResult {
+	server, ok := dnsServer()
+	if !ok {
+		return &PTRResult{Error: "dns_unavailable"}
+	}
+	name, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return &PTRResult{Error: "invalid_ip"}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypePTR)
+	msg.SetEdns0(4096, true)
+	msg.AuthenticatedData = true
+
+	reply, err := exchangeDNS(ctx, msg, server)
+	if err != nil {
+		return &PTRResult{Error: "lookup_failed"}
+	}
+
+	result := &PTRResult{DNSSECValidated: reply.AuthenticatedData}
+	switch reply.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		result.Error = "no_ptr_record"
+		return result
+	default:
+		result.Error = "lookup_failed"
+		return result
+	}
+	for _, rr := range reply.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			result.Names = append(result.Names, strings.TrimSuffix(ptr.Ptr, "."))
+		}
+	}
+	if len(result.Names) == 0 {
+		result.Error = "no_ptr_record"
+	}
+	return result
+}
+
+// lookupPTRCached is lookupPTR through enrichmentCache. Only definite answers
+// are cached; transient failures are retried on the next check.
+func lookupPTRCached(ctx context.Context, ip string) *PTRResult {
+	if enrichmentCache == nil {
+		return lookupPTR(ctx, ip)
+	}
+	key := "ptr|" + ip
+	if cached, ok := enrichmentCache.Get(key); ok {
+		return cached.(*PTRResult)
+	}
+	result := lookupPTR(ctx, ip)
+	if result.Error == "" || result.Error == "no_ptr_record" {
+		enrichmentCache.Set(key, result)
+	}
+	return result
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// FamilyResult is the outcome of dialing one address family
+type FamilyResult struct {
+	Address   string `json:"address"`
+	Reachable bool   `json:"reachable"`
+	LatencyMs int64  `json:"latency_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// DualStackResult reports both families of a dual-stack check
+type DualStackResult struct {
+	IPv4  FamilyResult `json:"ipv4"`
+	IPv6  FamilyResult `json:"ipv6"`
+	First string       `json:"first,omitempty"` // "ipv4", "ipv6" or empty
+}
+
+type familyDial struct {
+	family  string
+	address string
+	conn    net.Conn
+	latency int64
+	err     error
+}
+
+// dialDualStack races an IPv6 and an IPv4 dial in the style of Happy
+// Eyeballs (RFC 8305): IPv6 starts first and IPv4 follows after
+// config.HappyEyeballsDelay, or immediately if IPv6 fails. Both dials run to
+// completion so that each family is reported. The connection that succeeded
+// first is returned together with its address; the other one is closed.
+func dialDualStack(ctx context.Context, ipv4, ipv6 string, port int) (net.Conn, string, int64, *DualStackResult) {
+	results := make(chan familyDial, 2)
+	dial := func(family, address string) {
+		conn, latency, err := dialPort(ctx, address, port)
+		results <- familyDial{family: family, address: address, conn: conn, latency: latency, err: err}
+	}
+
+	go dial("ipv6", ipv6)
+
+	startIPv4 := time.NewTimer(config.HappyEyeballsDelay)
+	defer startIPv4.Stop()
+
+	var (
+		dials    []familyDial
+		started4 bool
+	)
+	for len(dials) < 2 {
+		select {
+		case <-startIPv4.C:
+			if !started4 {
+				started4 = true
+				go dial("ipv4", ipv4)
+			}
+		case d := <-results:
+			dials = append(dials, d)
+			if d.family == "ipv6" && d.err != nil && !started4 {
+				started4 = true
+				go dial("ipv4", ipv4)
+			}
+		}
+	}
+
+	ds := &DualStackResult{
+		IPv4: FamilyResult{Address: ipv4},
+		IPv6: FamilyResult{Address: ipv6},
+	}
+
+	var (
+		winner  net.Conn
+		address string
+		latency int64
+	)
+	for _, d := range dials {
+		fr := &ds.IPv4
+		if d.family == "ipv6" {
+			fr = &ds.IPv6
+		}
+		if d.err != nil {
+			fr.Error = errorCode("connection_failed", d.err)
+			if isResourceExhausted(d.err) {
+				fr.Error = errorCode("server_resource_exhausted", d.err)
+				reportResourceExhausted(port, d.err)
+			}
+			continue
+		}
+		fr.Reachable = true
+		fr.LatencyMs = d.latency
+		if winner == nil {
+			winner, address, latency = d.conn, d.address, d.latency
+			ds.First = d.family
+		} else {
+			d.conn.Close()
+		}
+	}
+
+	return winner, address, latency, ds
+}
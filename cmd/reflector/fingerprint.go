@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS extension IDs excluded from the JA4 extension hash
+const (
+	extServerName = 0x0000
+	extALPN       = 0x0010
+)
+
+type FingerprintResponse struct {
+	Success   bool   `json:"success"`
+	ClientIP  string `json:"client_ip"`
+	Timestamp string `json:"timestamp"`
+	JA3       string `json:"ja3,omitempty"`
+	JA3Hash   string `json:"ja3_hash,omitempty"`
+	JA4       string `json:"ja4,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// TLSFingerprint is the fingerprint of a single inbound ClientHello
+type TLSFingerprint struct {
+	JA3     string
+	JA3Hash string
+	JA4     string
+}
+
+// FingerprintStore maps inbound TLS connections (by remote address) to the
+// fingerprint of their ClientHello.
+type FingerprintStore struct {
+	fingerprints map[string]TLSFingerprint
+	mu           sync.RWMutex
+}
+
+func NewFingerprintStore() *FingerprintStore {
+	return &FingerprintStore{
+		fingerprints: make(map[string]TLSFingerprint),
+	}
+}
+
+// GetConfigForClient records the fingerprint of every ClientHello. It is meant
+// to be installed as tls.Config.GetConfigForClient and never alters the config.
+func (f *FingerprintStore) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if hello.Conn != nil {
+		fp := fingerprintClientHello(hello)
+		f.mu.Lock()
+		f.fingerprints[hello.Conn.RemoteAddr().String()] = fp
+		f.mu.Unlock()
+	}
+	return nil, nil
+}
+
+// ConnState drops fingerprints of closed connections. It is meant to be
+// installed as http.Server.ConnState.
+func (f *FingerprintStore) ConnState(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		f.mu.Lock()
+		delete(f.fingerprints, conn.RemoteAddr().String())
+		f.mu.Unlock()
+	}
+}
+
+func (f *FingerprintStore) Get(remoteAddr string) (TLSFingerprint, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fp, ok := f.fingerprints[remoteAddr]
+	return fp, ok
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinUint16(values []uint16, format string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = fmt.Sprintf(format, v)
+	}
+	return out
+}
+
+// fingerprintClientHello computes the JA3 and JA4 fingerprints of hello
+func fingerprintClientHello(hello *tls.ClientHelloInfo) TLSFingerprint {
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	versions := withoutGREASE(hello.SupportedVersions)
+
+	var maxVersion uint16
+	for _, v := range versions {
+		maxVersion = max(maxVersion, v)
+	}
+
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, c := range hello.SupportedCurves {
+		if !isGREASE(uint16(c)) {
+			curves = append(curves, uint16(c))
+		}
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+
+	// JA3 uses the legacy record version, which TLS 1.3 clients pin to 1.2
+	ja3Version := min(maxVersion, tls.VersionTLS12)
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(ja3Version)),
+		strings.Join(joinUint16(ciphers, "%d"), "-"),
+		strings.Join(joinUint16(extensions, "%d"), "-"),
+		strings.Join(joinUint16(curves, "%d"), "-"),
+		strings.Join(joinUint16(points, "%d"), "-"),
+	}, ",")
+	ja3Sum := md5.Sum([]byte(ja3))
+
+	return TLSFingerprint{
+		JA3:     ja3,
+		JA3Hash: hex.EncodeToString(ja3Sum[:]),
+		JA4:     ja4(hello, maxVersion, ciphers, extensions),
+	}
+}
+
+// ja4 builds the JA4 fingerprint (https://github.com/FoxIO-LLC/ja4)
+func ja4(hello *tls.ClientHelloInfo, version uint16, ciphers, extensions []uint16) string {
+	versionCode := map[uint16]string{
+		tls.VersionTLS10: "10",
+		tls.VersionTLS11: "11",
+		tls.VersionTLS12: "12",
+		tls.VersionTLS13: "13",
+	}[version]
+	if versionCode == "" {
+		versionCode = "00"
+	}
+
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		proto := hello.SupportedProtos[0]
+		alpn = string(proto[0]) + string(proto[len(proto)-1])
+	}
+
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s", versionCode, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	sortedCiphers := slices.Clone(ciphers)
+	slices.Sort(sortedCiphers)
+
+	var hashedExtensions []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			hashedExtensions = append(hashedExtensions, e)
+		}
+	}
+	slices.Sort(hashedExtensions)
+
+	sigAlgs := make([]uint16, len(hello.SignatureSchemes))
+	for i, s := range hello.SignatureSchemes {
+		sigAlgs[i] = uint16(s)
+	}
+
+	extPart := strings.Join(joinUint16(hashedExtensions, "%04x"), ",")
+	if len(sigAlgs) > 0 {
+		extPart += "_" + strings.Join(joinUint16(sigAlgs, "%04x"), ",")
+	}
+
+	return prefix + "_" + ja4Hash(strings.Join(joinUint16(sortedCiphers, "%04x"), ",")) + "_" + ja4Hash(extPart)
+}
+
+// ja4Hash returns the first 12 hex characters of the SHA-256 of s
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func handleFingerprint(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	if !rateLimiter.GetLimiter(clientIP).Allow() {
+		w.WriteHeader(http.StatusTooManyRequests)
+		encodeResponse(json.NewEncoder(w), FingerprintResponse{
+			Success:   false,
+			ClientIP:  clientIP,
+			Timestamp: formatTimestamp(time.Now()),
+			Error:     "rate_limit_exceeded",
+			Message:   "Too many requests. Please try again later.",
+		})
+		return
+	}
+
+	var fp TLSFingerprint
+	ok := false
+	if r.TLS != nil && fingerprints != nil {
+		fp, ok = fingerprints.Get(r.RemoteAddr)
+	}
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		encodeResponse(json.NewEncoder(w), FingerprintResponse{
+			Success:   false,
+			ClientIP:  clientIP,
+			Timestamp: formatTimestamp(time.Now()),
+			Error:     "tls_required",
+			Message:   "Fingerprinting requires a TLS connection terminated by the reflector",
+		})
+		return
+	}
+
+	encodeResponse(json.NewEncoder(w), FingerprintResponse{
+		Success:   true,
+		ClientIP:  clientIP,
+		Timestamp: formatTimestamp(time.Now()),
+		JA3:       fp.JA3,
+		JA3Hash:   fp.JA3Hash,
+		JA4:       fp.JA4,
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a single past check of one client
+type HistoryEntry struct {
+	Timestamp string          `json:"timestamp"`
+	Ports     []int           `json:"ports"`
+	Results   map[string]bool `json:"results"`
+}
+
+type HistoryResponse struct {
+	Success   bool           `json:"success"`
+	ClientIP  string         `json:"client_ip"`
+	Timestamp string         `json:"timestamp"`
+	Entries   []HistoryEntry `json:"entries,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Message   string         `json:"message,omitempty"`
+}
+
+// HistoryStore keeps the last perIP checks of up to maxIPs IPs, evicting
+// the least recently used IP when full. IPs are kept in full: anonymized
+// keys would let neighbors in the same /24 or /48 read each other's checks.
+type HistoryStore struct {
+	perIP  int
+	maxIPs int
+	lru    *list.List
+	items  map[string]*list.Element
+	mu     sync.Mutex
+}
+
+type historyItem struct {
+	ip      string
+	entries []HistoryEntry // oldest first
+}
+
+func NewHistoryStore(perIP, maxIPs int) *HistoryStore {
+	return &HistoryStore{
+		perIP:  perIP,
+		maxIPs: maxIPs,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+// Add records entry for ip
+func (h *HistoryStore) Add(ip string, entry HistoryEntry) {
+	key := normalizeIP(ip)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	elem, exists := h.items[key]
+	if !exists {
+		if h.lru.Len() >= h.maxIPs {
+			oldest := h.lru.Back()
+			h.lru.Remove(oldest)
+			delete(h.items, oldest.Value.(*historyItem).ip)
+		}
+		elem = h.lru.PushFront(&historyItem{ip: key})
+		h.items[key] = elem
+	} else {
+		h.lru.MoveToFront(elem)
+	}
+
+	item := elem.Value.(*historyItem)
+	item.entries = append(item.entries, entry)
+	if len(item.entries) > h.perIP {
+		item.entries = item.entries[len(item.entries)-h.perIP:]
+	}
+}
+
+// Get returns up to limit entries for ip, newest first
+func (h *HistoryStore) Get(ip string, limit int) []HistoryEntry {
+	key := normalizeIP(ip)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	elem, exists := h.items[key]
+	if !exists {
+		return nil
+	}
+
+	entries := elem.Value.(*historyItem).entries
+	result := make([]HistoryEntry, 0, min(limit, len(entries)))
+	for i := len(entries) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, entries[i])
+	}
+	return result
+}
+
+// handleHistory returns the checks recorded for the caller. The caller is
+// identified by trustedClientIP, as when handleCheck records them, so a forged
+// X-Forwarded-For header cannot be used to read someone else's history.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	clientIP := trustedClientIP(r)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if history == nil {
+		w.WriteHeader(http.StatusNotFound)
+		encodeResponse(json.NewEncoder(w), HistoryResponse{
+			Success:   false,
+			ClientIP:  clientIP,
+			Timestamp: formatTimestamp(time.Now()),
+			Error:     "history_disabled",
+			Message:   "Check history is not enabled on this server",
+		})
+		return
+	}
+
+	if !rateLimiter.GetLimiter(clientIP).Allow() {
+		w.WriteHeader(http.StatusTooManyRequests)
+		encodeResponse(json.NewEncoder(w), HistoryResponse{
+			Success:   false,
+			ClientIP:  clientIP,
+			Timestamp: formatTimestamp(time.Now()),
+			Error:     "rate_limit_exceeded",
+			Message:   "Too many requests. Please try again later.",
+		})
+		return
+	}
+
+	limit := config.HistorySize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if l, err := strconv.Atoi(v); err == nil && l > 0 && l < limit {
+			limit = l
+		}
+	}
+
+	encodeResponse(json.NewEncoder(w), HistoryResponse{
+		Success:   true,
+		ClientIP:  clientIP,
+		Timestamp: formatTimestamp(time.Now()),
+		Entries:   history.Get(clientIP, limit),
+	})
+}
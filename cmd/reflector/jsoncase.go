@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// encodeResponse writes v to enc, renaming the JSON fields of structs to
+// camelCase when REFLECTOR_JSON_FIELD_CASE=camel. Map keys (ports, group
+// names) are left alone and the field order is preserved.
+func encodeResponse(enc *json.Encoder, v interface{}) error {
+	if !config.CamelCaseJSON {
+		return enc.Encode(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := camelizeValue(dec, &buf, reflect.TypeOf(v)); err != nil {
+		return err
+	}
+	return enc.Encode(json.RawMessage(buf.Bytes()))
+}
+
+// camelizeValue copies the next JSON value from dec to buf. t is the Go type
+// the value was marshaled from and tells struct objects apart from maps.
+func camelizeValue(dec *json.Decoder, buf *bytes.Buffer, t reflect.Type) error {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			var elem reflect.Type
+			if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+				elem = t.Elem()
+			}
+			buf.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err := camelizeValue(dec, buf, elem); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+			_, err = dec.Token()
+			return err
+		}
+
+		var fields map[string]reflect.Type
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		} else if t != nil && t.Kind() == reflect.Map {
+			elem = t.Elem()
+		}
+		buf.WriteByte('{')
+		for i := 0; dec.More(); i++ {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := keyTok.(string)
+			valueType := elem
+			if fields != nil {
+				valueType = fields[key]
+				key = camelCase(key)
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, key)
+			buf.WriteByte(':')
+			if err := camelizeValue(dec, buf, valueType); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		_, err = dec.Token()
+		return err
+	case string:
+		writeJSONString(buf, tok)
+	case json.Number:
+		buf.WriteString(tok.String())
+	case bool:
+		if tok {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case nil:
+		buf.WriteString("null")
+	}
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+// jsonFieldCache maps a struct type to its JSON field names and their types
+var jsonFieldCache sync.Map
+
+// jsonFields returns the JSON names of t's fields, including those of
+// embedded structs, which encoding/json flattens into the parent
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	if cached, ok := jsonFieldCache.Load(t); ok {
+		return cached.(map[string]reflect.Type)
+	}
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for k, v := range jsonFields(embedded) {
+					if _, exists := fields[k]; !exists {
+						fields[k] = v
+					}
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	jsonFieldCache.Store(t, fields)
+	return fields
+}
+
+// camelCase turns a snake_case name such as "client_ip" into "clientIp"
+func camelCase(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
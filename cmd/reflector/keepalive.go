@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// How long a keepalive connection is held by default and at most
+const (
+	defaultKeepaliveHold = 5 * time.Second
+	maxKeepaliveHold     = 10 * time.Second
+)
+
+// Keepalive probes are sent every second once the connection is idle, so
+// a path dropping idle connections is noticed within the hold time
+const keepaliveInterval = time.Second
+
+// parseKeepaliveHold parses the keepalive_hold parameter, a Go duration
+// of at most maxKeepaliveHold
+func parseKeepaliveHold(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("keepalive_hold must be a positive duration")
+	}
+	if d > maxKeepaliveHold {
+		return 0, fmt.Errorf("keepalive_hold must not exceed %s", maxKeepaliveHold)
+	}
+	return d, nil
+}
+
+// probeStable opens a separate connection to host:port with TCP keepalive
+// enabled and holds it idle for hold (or until ctx ends). It reports whether
+// the connection was still alive at the end and, if not, why it ended.
+// Anything the service sends meanwhile is read and discarded.
+func probeStable(ctx context.Context, host string, port int, hold time.Duration) (bool, time.Duration, string) {
+	conn, _, err := dialPort(ctx, host, port)
+	if err != nil {
+		return false, 0, "connection_failed"
+	}
+	defer conn.Close()
+
+	// Through the upstream proxy the keepalives are sent by the proxy
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     keepaliveInterval,
+			Interval: keepaliveInterval,
+			Count:    3,
+		})
+	}
+
+	start := time.Now()
+	deadline := start.Add(hold)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 512)
+	for {
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+		held := time.Since(start)
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return true, held, ""
+		case errors.Is(err, io.EOF):
+			return false, held, "closed_by_peer"
+		case errors.Is(err, syscall.ECONNRESET):
+			return false, held, "connection_reset"
+		case errors.Is(err, syscall.ETIMEDOUT):
+			// Keepalive probes went unanswered
+			return false, held, "keepalive_timeout"
+		default:
+			return false, held, "connection_lost"
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// Size of the payload sent by the large packet probe. It spans several
+// full-size segments on any common MTU without being a meaningful upload.
+const largePacketSize = 8 << 10
+
+// How often the send queue is polled while waiting for the ACKs
+const largePacketPollInterval = 10 * time.Millisecond
+
+var errLargePacketUnsupported = errors.New("large packet probe not supported")
+
+// probeLargePacket writes largePacketSize bytes on a fresh connection and
+// reports whether the peer acknowledged all of them within config.Timeout.
+// Small packets getting through while full-size ones vanish is the typical
+// symptom of an MTU black hole on a VPN or tunnel. This is not path MTU
+// discovery; it only tells whether large segments make it at all.
+func probeLargePacket(host string, port int) (bool, error) {
+	conn, err := newDialer(config.Timeout).Dial("tcp", formatHostPort(host, port))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// The kernel's send queue is only visible on a direct TCP connection
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return false, errLargePacketUnsupported
+	}
+
+	deadline := time.Now().Add(config.Timeout)
+	conn.SetWriteDeadline(deadline)
+	if _, err := conn.Write(bytes.Repeat([]byte{'X'}, largePacketSize)); err != nil {
+		return false, err
+	}
+
+	for {
+		unacked, err := unackedBytes(tcpConn)
+		if err != nil {
+			return false, err
+		}
+		if unacked == 0 {
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(largePacketPollInterval)
+	}
+}
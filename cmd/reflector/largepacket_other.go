@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// unackedBytes is only implemented on Linux
+func unackedBytes(conn *net.TCPConn) (int, error) {
+	return 0, errLargePacketUnsupported
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/netutil"
+)
+
+// Minimum interval between "connection limit reached" log lines
+const connLimitLogInterval = time.Minute
+
+// listen opens a TCP listener on addr, limited to config.MaxConnections
+// concurrently accepted connections. Further connections wait in the
+// kernel's accept queue.
+func listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxConnections <= 0 {
+		return ln, nil
+	}
+	return &limitListener{
+		Listener: netutil.LimitListener(ln, config.MaxConnections),
+		max:      int64(config.MaxConnections),
+	}, nil
+}
+
+// limitListener logs when its LimitListener runs at capacity
+type limitListener struct {
+	net.Listener
+	max       int64
+	active    atomic.Int64
+	lastLimit atomic.Int64 // unix time of the last log line
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.active.Add(1) >= l.max {
+		now := time.Now().Unix()
+		last := l.lastLimit.Load()
+		if now-last >= int64(connLimitLogInterval.Seconds()) && l.lastLimit.CompareAndSwap(last, now) {
+			log.Printf("Connection limit reached on %s (%d connections)", l.Addr(), l.max)
+			logger.LogError("warn", "connection limit reached", map[string]interface{}{
+				"listener":        l.Addr().String(),
+				"max_connections": l.max,
+			})
+		}
+	}
+	return &limitConn{Conn: conn, release: func() { l.active.Add(-1) }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
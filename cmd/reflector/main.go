@@ -4,32 +4,101 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"golang.org/x/time/rate"
+	"golang.org/x/net/idna"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // Configuration
 type Config struct {
-	Port            string
-	AllowedPorts    map[int]bool
-	Timeout         time.Duration
-	RateLimitPerMin int
-	TrustedProxies  []string
-	LogDir          string
+	Port                   string
+	AllowedPorts           map[int]bool
+	Timeout                time.Duration
+	RateLimitPerMin        int
+	TrustedProxies         []string
+	LogDir                 string
+	TLSMinVersion          uint16
+	TLSMaxVersion          uint16
+	MinAcceptableTLS       uint16 // lower versions get weak_tls_version
+	APIKeysFile            string
+	RedactFields           map[string]bool
+	TLSPort                string
+	TLSCertFile            string
+	TLSKeyFile             string
+	HappyEyeballsDelay     time.Duration
+	HistorySize            int // entries kept per IP, 0 = disabled
+	HistoryMaxIPs          int
+	ReadTimeout            time.Duration
+	WriteTimeout           time.Duration
+	IdleTimeout            time.Duration
+	BannerProbes           map[int][]byte
+	ChallengeMaxBytes      int64
+	MaintenanceMessage     string
+	NotFoundMessage        string
+	MaintenanceRetryAfter  time.Duration
+	DNSResolver            string
+	SimpleCacheTTL         time.Duration
+	MaxConcurrentChecks    int
+	CheckQueueSize         int
+	DebugEchoRequireKey    bool
+	Debug                  bool
+	MaxDialsPerCheck       int
+	PortGroups             map[string][]int
+	UserAgent              string
+	SMTPHelloName          string // announced in EHLO
+	BannerAllowCIDRs       []*net.IPNet
+	BannerDenyCIDRs        []*net.IPNet
+	UpstreamProxy          *url.URL
+	RateLimitAlgorithm     string
+	MaxCheckDuration       time.Duration
+	LogVerifiedIPs         bool
+	BannerRedact           []*regexp.Regexp
+	MaxConnections         int
+	CamelCaseJSON          bool
+	LogQuery               bool
+	Peers                  []Peer
+	PeerTimeout            time.Duration
+	EnrichmentCacheTTL     time.Duration
+	EnrichmentCacheSize    int
+	ExpiryWarnDays         int
+	ExpiryCriticalDays     int
+	ChallengeRequiredPorts map[int]bool
+	RateLimitPerMinIPv6    int // 0 = same as RateLimitPerMin
+	RateLimitIPv6Prefix    int
+	BadgeCacheTTL          time.Duration
+	BannerConnectTimeout   time.Duration
+	BannerReadTimeout      time.Duration
+	DoNotLogRequireKey     bool
+	SelfTest               bool
+	SelfTestTarget         string // host:port dialed by the self-test
+	ChallengeMaxRedirects  int
+	ChallengeAllowedCIDRs  []*net.IPNet
+	ChallengeAllowedHosts  []string // ASCII, lowercase; "*." prefix matches subdomains
+	RateLimitExemptCIDRs   []*net.IPNet
+	TimestampFormat        string // a namedTimestampFormats key or a Go layout
+	TimestampLocation      *time.Location
 }
 
 var config = Config{
@@ -41,117 +110,253 @@ var config = Config{
 		8080: true,
 		8443: true,
 	},
-	Timeout:         5 * time.Second,
-	RateLimitPerMin: 10,
-	TrustedProxies:  []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
-	LogDir:          "/logs",
+	Timeout:               5 * time.Second,
+	RateLimitPerMin:       10,
+	RateLimitAlgorithm:    "token",
+	RateLimitIPv6Prefix:   64,
+	BadgeCacheTTL:         time.Minute,
+	BannerConnectTimeout:  2 * time.Second,
+	BannerReadTimeout:     2 * time.Second,
+	SelfTestTarget:        "1.1.1.1:443",
+	TimestampFormat:       "rfc3339",
+	TimestampLocation:     time.UTC,
+	TrustedProxies:        []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
+	LogDir:                "/logs",
+	TLSPort:               "8443",
+	HappyEyeballsDelay:    300 * time.Millisecond,
+	HistoryMaxIPs:         1000,
+	ReadTimeout:           30 * time.Second,
+	WriteTimeout:          30 * time.Second,
+	IdleTimeout:           60 * time.Second,
+	ChallengeMaxBytes:     256,
+	ChallengeMaxRedirects: 3,
+	MaintenanceMessage:    "The service is undergoing maintenance. Please try again later.",
+	NotFoundMessage:       "No such endpoint.",
+	MaintenanceRetryAfter: 5 * time.Minute,
+	CheckQueueSize:        100,
+	UserAgent:             "can-i-haz-reachability/1.0",
+	SMTPHelloName:         "reflector.invalid",
+	MaxCheckDuration:      15 * time.Second,
+	PeerTimeout:           20 * time.Second,
+	EnrichmentCacheTTL:    5 * time.Minute,
+	EnrichmentCacheSize:   10000,
+	ExpiryWarnDays:        30,
+	MinAcceptableTLS:      tls.VersionTLS12,
 }
 
 // Response types
+
+// schemaVersion is reported in /check and /health responses. Bump it when
+// the shape of a response changes incompatibly.
+const schemaVersion = 1
+
+// PortResultEntry is a PortResult together with its port, as used in
+// results_list and for the lines of a format=ndjson response
+type PortResultEntry struct {
+	Port int `json:"port"`
+	PortResult
+}
+
 type CheckResponse struct {
-	Success   bool                  `json:"success"`
-	ClientIP  string                `json:"client_ip"`
-	IPVersion int                   `json:"ip_version,omitempty"`
-	Timestamp string                `json:"timestamp"`
-	Results   map[string]PortResult `json:"results,omitempty"`
-	Error     string                `json:"error,omitempty"`
-	Message   string                `json:"message,omitempty"`
+	Success             bool                             `json:"success"`
+	ClientIP            string                           `json:"client_ip"`
+	IPVersion           int                              `json:"ip_version,omitempty"`
+	Timestamp           string                           `json:"timestamp"`
+	Results             map[string]PortResult            `json:"results,omitempty"`
+	ResultsList         []PortResultEntry                `json:"results_list,omitempty"` // in requested order
+	Error               string                           `json:"error,omitempty"`
+	Message             string                           `json:"message,omitempty"`
+	MatchedRange        string                           `json:"matched_range,omitempty"`
+	AllExpectedOpen     *bool                            `json:"all_expected_open,omitempty"`
+	ExpectedUnreachable []int                            `json:"expected_unreachable,omitempty"`
+	AllExpectedClosed   *bool                            `json:"all_expected_closed,omitempty"`
+	ExpectedReachable   []int                            `json:"expected_reachable,omitempty"` // expected closed, but not confirmed unreachable
+	PTR                 *PTRResult                       `json:"ptr,omitempty"`
+	FailedConditions    []string                         `json:"failed_conditions,omitempty"`
+	PortGroups          map[string][]int                 `json:"port_groups,omitempty"`
+	Traceroute          *TracerouteResult                `json:"traceroute,omitempty"`
+	Notes               []string                         `json:"notes,omitempty"`
+	Warnings            []string                         `json:"warnings,omitempty"` // deprecated parameters and defaults, not TLS
+	CIDR                string                           `json:"cidr,omitempty"`
+	CIDRResults         map[string]map[string]PortResult `json:"cidr_results,omitempty"` // address -> port -> result
+	SchemaVersion       int                              `json:"schema_version"`
 }
 
 type PortResult struct {
-	Reachable bool          `json:"reachable"`
-	LatencyMs int64         `json:"latency_ms,omitempty"`
-	Error     string        `json:"error,omitempty"`
-	TLS       *TLSInfo      `json:"tls,omitempty"`
-	Challenge *ChallengeRes `json:"challenge,omitempty"`
-	Banner    string        `json:"banner,omitempty"`
+	Reachable         bool             `json:"reachable"`
+	LatencyMs         int64            `json:"latency_ms,omitempty"`
+	Error             string           `json:"error,omitempty"`
+	TLS               *TLSInfo         `json:"tls,omitempty"`
+	Challenge         *ChallengeRes    `json:"challenge,omitempty"`
+	Banner            string           `json:"banner,omitempty"`
+	BannerError       string           `json:"banner_error,omitempty"`
+	ResetAfterConnect bool             `json:"reset_after_connect,omitempty"`
+	DualStack         *DualStackResult `json:"dual_stack,omitempty"`
+	Service           string           `json:"service,omitempty"`
+	HTTPStatus        int              `json:"http_status,omitempty"`
+	TTFBMs            int64            `json:"ttfb_ms,omitempty"` // http_path request sent to first response byte
+	HTTPHealthy       bool             `json:"http_healthy,omitempty"`
+	HTTPError         string           `json:"http_error,omitempty"`
+	HTTPVersion       string           `json:"http_version,omitempty"`
+	SSHProtocol       string           `json:"ssh_protocol,omitempty"`
+	SSHSoftware       string           `json:"ssh_software,omitempty"`
+	SSHComment        string           `json:"ssh_comment,omitempty"`
+	RedirectsToHTTPS  *bool            `json:"redirects_to_https,omitempty"`
+	RedirectTarget    string           `json:"redirect_target,omitempty"`
+	LargePacketOK     *bool            `json:"large_packet_ok,omitempty"`
+	LargePacketError  string           `json:"large_packet_error,omitempty"`
+	SMTP              *SMTPResult      `json:"smtp,omitempty"`
+	TFOAttempted      *bool            `json:"tfo_attempted,omitempty"`
+	TFOAccepted       *bool            `json:"tfo_accepted,omitempty"`
+	LocalAddr         string           `json:"local_addr,omitempty"` // reflector side of the connection
+	HTTPSHealthy      *bool            `json:"https_healthy,omitempty"`
+	HTTPSProblems     []string         `json:"https_problems,omitempty"`
+	TCPInfo           *TCPConnInfo     `json:"tcp_info,omitempty"`
+	NotHTTP           *bool            `json:"not_http,omitempty"`
+	NotHTTPSample     string           `json:"not_http_sample,omitempty"` // first bytes the service sent instead
+	TLSError          string           `json:"tls_error,omitempty"`       // why the TLS analysis failed
+	Stable            *bool            `json:"stable,omitempty"`          // connection survived the keepalive hold
+	StableHeldMs      int64            `json:"stable_held_ms,omitempty"`
+	StableError       string           `json:"stable_error,omitempty"`
+	OptionsStatus     int              `json:"options_status,omitempty"` // status of the OPTIONS probe
+	AllowMethods      []string         `json:"allow_methods,omitempty"`
 }
 
 type TLSInfo struct {
-	Version     string   `json:"version"`
-	CipherSuite string   `json:"cipher_suite"`
-	Certificate CertInfo `json:"certificate"`
-	ChainLength int      `json:"chain_length"`
-	Warnings    []string `json:"warnings,omitempty"`
+	Version           string   `json:"version"`
+	CipherSuite       string   `json:"cipher_suite"`
+	CipherGrade       string   `json:"cipher_grade"` // strong, acceptable or weak
+	Certificate       CertInfo `json:"certificate"`
+	ChainLength       int      `json:"chain_length"`
+	ChainValid        bool     `json:"chain_valid"` // verified against the system roots
+	Warnings          []string `json:"warnings,omitempty"`
+	SNI               string   `json:"sni,omitempty"`
+	SNIUnicode        string   `json:"sni_unicode,omitempty"`
+	TLSResumption     *bool    `json:"tls_resumption,omitempty"`
+	ChainPEM          string   `json:"chain_pem,omitempty"`
+	ChainPEMTruncated bool     `json:"chain_pem_truncated,omitempty"`
+	ConnectMs         int64    `json:"connect_ms"`
+	HandshakeMs       int64    `json:"handshake_ms"`
+	SCTCount          int      `json:"sct_count"`
+	TrustedByMozilla  *bool    `json:"trusted_by_mozilla,omitempty"`
 }
 
 type CertInfo struct {
-	Subject         string   `json:"subject"`
-	Issuer          string   `json:"issuer"`
-	SelfSigned      bool     `json:"self_signed"`
-	NotBefore       string   `json:"not_before"`
-	NotAfter        string   `json:"not_after"`
-	DaysUntilExpiry int      `json:"days_until_expiry"`
-	DNSNames        []string `json:"dns_names,omitempty"`
-	Serial          string   `json:"serial"`
+	Subject               string   `json:"subject"`
+	Issuer                string   `json:"issuer"`
+	SelfSigned            bool     `json:"self_signed"`
+	NotBefore             string   `json:"not_before"`
+	NotAfter              string   `json:"not_after"`
+	DaysUntilExpiry       int      `json:"days_until_expiry"`
+	DNSNames              []string `json:"dns_names,omitempty"`
+	Serial                string   `json:"serial"`
+	IssuingCertURLs       []string `json:"issuing_cert_urls,omitempty"`
+	OCSPServers           []string `json:"ocsp_servers,omitempty"`
+	CRLDistributionPoints []string `json:"crl_distribution_points,omitempty"`
+	PolicyOIDs            []string `json:"policy_oids,omitempty"`
+	ValidationLevel       string   `json:"validation_level,omitempty"` // DV, IV, OV or EV, best effort
 }
 
 type ChallengeRes struct {
-	Verified bool   `json:"verified"`
-	Token    string `json:"token,omitempty"`
-	Error    string `json:"error,omitempty"`
-	Expected string `json:"expected,omitempty"`
-	Received string `json:"received,omitempty"`
+	Verified         bool   `json:"verified"`
+	Token            string `json:"token,omitempty"`
+	Error            string `json:"error,omitempty"`
+	Expected         string `json:"expected,omitempty"`
+	Received         string `json:"received,omitempty"`
+	Host             string `json:"host,omitempty"`
+	HostUnicode      string `json:"host_unicode,omitempty"`
+	ConnectionReused bool   `json:"connection_reused,omitempty"` // fetched over the port check connection
 }
 
 type HealthResponse struct {
-	Status         string `json:"status"`
-	UptimeSeconds  int64  `json:"uptime_seconds"`
-	Version        string `json:"version"`
-	ChecksLastHour int64  `json:"checks_last_hour"`
-	Goroutines     int    `json:"goroutines"`
+	Status         string   `json:"status"`
+	UptimeSeconds  int64    `json:"uptime_seconds"`
+	Version        string   `json:"version"`
+	ChecksLastHour int64    `json:"checks_last_hour"`
+	Goroutines     int      `json:"goroutines"`
+	Problems       []string `json:"problems,omitempty"`
+	ActiveChecks   int64    `json:"active_checks"`
+	QueuedChecks   int64    `json:"queued_checks"`
+	SchemaVersion  int      `json:"schema_version"`
 }
 
 // Rate Limiter
 type IPRateLimiter struct {
-	limiters map[string]*rate.Limiter
+	limiters map[string]Limiter
 	mu       sync.RWMutex
 }
 
 func NewIPRateLimiter() *IPRateLimiter {
 	return &IPRateLimiter{
-		limiters: make(map[string]*rate.Limiter),
+		limiters: make(map[string]Limiter),
 	}
 }
 
-func (i *IPRateLimiter) GetLimiter(ip string) *rate.Limiter {
+func (i *IPRateLimiter) GetLimiter(ip string) Limiter {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	limiter, exists := i.limiters[ip]
+	// IPv4 clients are limited per address, IPv6 clients per prefix
+	// (/64 by default), since a single subscriber usually owns a whole
+	// prefix and could otherwise rotate through its addresses
+	key, limit := ip, config.RateLimitPerMin
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Unmap().Is6() {
+		prefix, _ := addr.Prefix(config.RateLimitIPv6Prefix)
+		key = prefix.String()
+		if config.RateLimitPerMinIPv6 > 0 {
+			limit = config.RateLimitPerMinIPv6
+		}
+	}
+
+	limiter, exists := i.limiters[key]
 	if !exists {
-		// Rate limit: requests per minute with burst
-		limiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(config.RateLimitPerMin)), config.RateLimitPerMin)
-		i.limiters[ip] = limiter
+		// Rate limit: requests per minute
+		limiter = newLimiter(limit, time.Minute)
+		i.limiters[key] = limiter
 	}
 	return limiter
 }
 
+// rateLimitExempt reports whether the client of r is in
+// REFLECTOR_RATE_LIMIT_EXEMPT_CIDRS. Forwarding headers are only believed
+// when the direct peer is a trusted proxy, so the exemption cannot be
+// claimed by sending X-Forwarded-For.
+func rateLimitExempt(r *http.Request) bool {
+	if len(config.RateLimitExemptCIDRs) == 0 {
+		return false
+	}
+	return containsIP(config.RateLimitExemptCIDRs, net.ParseIP(trustedClientIP(r)))
+}
+
 // Cleanup old limiters periodically
 func (i *IPRateLimiter) Cleanup() {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 	// Simple cleanup: remove all (they will be recreated on next request)
-	i.limiters = make(map[string]*rate.Limiter)
+	i.limiters = make(map[string]Limiter)
 }
 
 // Logger
 type Logger struct {
-	accessLog io.WriteCloser
-	errorLog  io.WriteCloser
-	mu        sync.Mutex
+	accessLog   io.WriteCloser
+	errorLog    io.WriteCloser
+	mu          sync.Mutex
+	writeFailed atomic.Bool
 }
 
 type AccessLogEntry struct {
-	Timestamp  string         `json:"ts"`
-	IP         string         `json:"ip"`
-	Method     string         `json:"method"`
-	Path       string         `json:"path"`
-	Ports      []int          `json:"ports,omitempty"`
-	Results    map[string]bool `json:"results,omitempty"`
-	DurationMs int64          `json:"duration_ms"`
-	Status     int            `json:"status"`
-	Error      string         `json:"error,omitempty"`
+	Timestamp         string          `json:"ts"`
+	IP                string          `json:"ip"`
+	Method            string          `json:"method"`
+	Path              string          `json:"path"`
+	Ports             []int           `json:"ports,omitempty"`
+	Results           map[string]bool `json:"results,omitempty"`
+	DurationMs        int64           `json:"duration_ms"`
+	Status            int             `json:"status"`
+	Error             string          `json:"error,omitempty"`
+	ChallengeVerified bool            `json:"challenge_verified,omitempty"`
+	Scheme            string          `json:"scheme,omitempty"`
+	Query             string          `json:"query,omitempty"`
 }
 
 func NewLogger(logDir string) (*Logger, error) {
@@ -185,24 +390,83 @@ func NewLogger(logDir string) (*Logger, error) {
 func (l *Logger) LogAccess(entry AccessLogEntry) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	// Anonymize IP before logging
-	entry.IP = anonymizeIP(entry.IP)
-	json.NewEncoder(l.accessLog).Encode(entry)
+	// Anonymize IP before logging, unless configured to keep the IPs of
+	// challenge-verified clients
+	if !entry.ChallengeVerified || !config.LogVerifiedIPs {
+		entry.IP = anonymizeIP(entry.IP)
+	}
+	l.writeFailed.Store(json.NewEncoder(l.accessLog).Encode(entry) != nil)
+}
+
+// doNotLog reports whether r asked with "X-Do-Not-Log: 1" for its check to
+// stay out of the access log and history. With REFLECTOR_DO_NOT_LOG_REQUIRE_KEY
+// only requests with a valid API key are honored.
+func doNotLog(r *http.Request) bool {
+	if r.Header.Get("X-Do-Not-Log") != "1" {
+		return false
+	}
+	if config.DoNotLogRequireKey {
+		key, err := authenticate(r)
+		return err == nil && key != nil
+	}
+	return true
+}
+
+// Query parameters that are never written to the access log
+var secretQueryParams = map[string]bool{
+	"api_key":      true,
+	"access_token": true,
+	"token":        true,
+	"password":     true,
+	"secret":       true,
+}
+
+// loggedQuery returns the query of r for the access log with secret
+// parameters stripped, or "" unless REFLECTOR_LOG_QUERY is enabled
+func loggedQuery(r *http.Request) string {
+	if !config.LogQuery || r.URL.RawQuery == "" {
+		return ""
+	}
+	query := r.URL.Query()
+	for name := range query {
+		if secretQueryParams[strings.ToLower(name)] {
+			query.Del(name)
+		}
+	}
+	// alt_ip is an address of the client and is anonymized like the IP;
+	// cidr is narrower than the anonymized IP, so only its anonymized
+	// address is kept
+	if altIP := query.Get("alt_ip"); altIP != "" {
+		query.Set("alt_ip", anonymizeIP(altIP))
+	}
+	if cidr := query.Get("cidr"); cidr != "" {
+		if addr, _, _ := strings.Cut(cidr, "/"); net.ParseIP(addr) != nil {
+			query.Set("cidr", anonymizeIP(addr))
+		} else {
+			query.Del("cidr")
+		}
+	}
+	return query.Encode()
 }
 
 func (l *Logger) LogError(level, msg string, fields map[string]interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	
+
 	entry := map[string]interface{}{
-		"ts":    time.Now().UTC().Format(time.RFC3339),
+		"ts":    formatTimestamp(time.Now()),
 		"level": level,
 		"msg":   msg,
 	}
 	for k, v := range fields {
 		entry[k] = v
 	}
-	json.NewEncoder(l.errorLog).Encode(entry)
+	l.writeFailed.Store(json.NewEncoder(l.errorLog).Encode(entry) != nil)
+}
+
+// Healthy reports whether the last log write succeeded
+func (l *Logger) Healthy() bool {
+	return !l.writeFailed.Load()
 }
 
 func (l *Logger) Close() {
@@ -212,35 +476,98 @@ func (l *Logger) Close() {
 
 // Global variables
 var (
-	rateLimiter *IPRateLimiter
-	logger      *Logger
-	startTime   time.Time
-	checkCount  int64
-	checkMu     sync.Mutex
+	rateLimiter     *IPRateLimiter
+	apiKeys         *APIKeyStore
+	fingerprints    *FingerprintStore
+	history         *HistoryStore
+	simpleCache     *TTLCache[bool]
+	enrichmentCache *TTLCache[any] // lookups about client IPs, keyed by "<kind>|<ip>"
+	admission       *AdmissionQueue
+	logger          *Logger
+	startTime       time.Time
+	checkCount      int64
+	checkMu         sync.Mutex
+
+	// Unix time of the last file descriptor exhaustion
+	lastResourceExhausted atomic.Int64
+
+	// Checks currently being executed
+	activeChecks atomic.Int64
 )
 
+// resourceExhaustedWindow is how long /health reports degraded after the
+// process last ran out of file descriptors
+const resourceExhaustedWindow = time.Minute
+
 // Private IP check
-var privateBlocks []*net.IPNet
+type privateBlock struct {
+	net  *net.IPNet
+	name string
+}
+
+var privateBlocks []privateBlock
 
 func init() {
-	privateCIDRs := []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-		"127.0.0.0/8",
-		"169.254.0.0/16",
-		"::1/128",
-		"fc00::/7",
-		"fe80::/10",
-	}
-	for _, cidr := range privateCIDRs {
-		_, block, _ := net.ParseCIDR(cidr)
-		privateBlocks = append(privateBlocks, block)
+	privateCIDRs := []struct {
+		cidr string
+		name string
+	}{
+		{"10.0.0.0/8", "rfc1918"},
+		{"172.16.0.0/12", "rfc1918"},
+		{"192.168.0.0/16", "rfc1918"},
+		{"127.0.0.0/8", "loopback"},
+		{"169.254.0.0/16", "link_local"},
+		{"::1/128", "loopback"},
+		{"fc00::/7", "ula"},
+		{"fe80::/10", "link_local"},
+	}
+	for _, c := range privateCIDRs {
+		_, block, _ := net.ParseCIDR(c.cidr)
+		privateBlocks = append(privateBlocks, privateBlock{net: block, name: c.name})
 	}
 }
 
-func isPrivateIP(ip net.IP) bool {
+// matchPrivateRange returns the name of the private range containing ip
+func matchPrivateRange(ip net.IP) (string, bool) {
 	for _, block := range privateBlocks {
+		if block.net.Contains(ip) {
+			return block.name, true
+		}
+	}
+	return "", false
+}
+
+// addBlockedCIDRs appends operator-defined ranges to privateBlocks
+func addBlockedCIDRs(cidrs string) error {
+	blocks, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		privateBlocks = append(privateBlocks, privateBlock{net: block, name: "blocked"})
+	}
+	return nil
+}
+
+// parseCIDRs parses a comma-separated list of CIDR ranges
+func parseCIDRs(cidrs string) ([]*net.IPNet, error) {
+	var blocks []*net.IPNet
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func containsIP(blocks []*net.IPNet, ip net.IP) bool {
+	for _, block := range blocks {
 		if block.Contains(ip) {
 			return true
 		}
@@ -248,15 +575,36 @@ func isPrivateIP(ip net.IP) bool {
 	return false
 }
 
+// bannerAllowed reports whether banner grabbing is permitted for clients at
+// ip. The deny list wins; a non-empty allow list admits only its ranges.
+func bannerAllowed(ip net.IP) bool {
+	if containsIP(config.BannerDenyCIDRs, ip) {
+		return false
+	}
+	return len(config.BannerAllowCIDRs) == 0 || containsIP(config.BannerAllowCIDRs, ip)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	_, private := matchPrivateRange(ip)
+	return private
+}
+
 // Get client IP from request
 func getClientIP(r *http.Request) string {
+	ip, _ := resolveClientIP(r)
+	return ip
+}
+
+// resolveClientIP returns the client IP together with where it was taken
+// from: "x-forwarded-for", "x-real-ip" or "remote_addr"
+func resolveClientIP(r *http.Request) (string, string) {
 	// Check X-Forwarded-For header
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		ips := strings.Split(xff, ",")
 		if len(ips) > 0 {
 			ip := strings.TrimSpace(ips[0])
 			if net.ParseIP(ip) != nil {
-				return ip
+				return normalizeIP(ip), "x-forwarded-for"
 			}
 		}
 	}
@@ -264,16 +612,74 @@ func getClientIP(r *http.Request) string {
 	// Check X-Real-IP header
 	if xri := r.Header.Get("X-Real-IP"); xri != "" {
 		if net.ParseIP(xri) != nil {
-			return xri
+			return normalizeIP(xri), "x-real-ip"
 		}
 	}
 
 	// Fall back to RemoteAddr
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return r.RemoteAddr
+		return normalizeIP(r.RemoteAddr), "remote_addr"
+	}
+	return normalizeIP(host), "remote_addr"
+}
+
+// trustedClientIP returns the client IP like resolveClientIP when the
+// direct peer is a trusted proxy, and the peer address otherwise
+func trustedClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if peer := net.ParseIP(host); peer != nil && isTrustedProxy(peer) {
+		return getClientIP(r)
+	}
+	return normalizeIP(host)
+}
+
+// requestScheme returns the scheme the client used: https when TLS was
+// terminated here, otherwise X-Forwarded-Proto if the request came from a
+// trusted proxy, otherwise http
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "http"
+	}
+	if peer := net.ParseIP(host); peer != nil && isTrustedProxy(peer) {
+		switch proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	return "http"
+}
+
+// isTrustedProxy reports whether ip lies in one of config.TrustedProxies
+func isTrustedProxy(ip net.IP) bool {
+	for _, cidr := range config.TrustedProxies {
+		_, block, err := net.ParseCIDR(cidr)
+		if err == nil && block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeIP returns the canonical form of ipStr. IPv4-mapped IPv6
+// addresses (::ffff:1.2.3.4), as seen on dual-stack listeners, become plain
+// IPv4 so version detection, anonymization and dialing treat them as IPv4.
+func normalizeIP(ipStr string) string {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return ipStr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
 	}
-	return host
+	return ip.String()
 }
 
 // Get IP version
@@ -291,9 +697,9 @@ func anonymizeIP(ipStr string) string {
 		return ipStr
 	}
 
-	if ip.To4() != nil {
+	if ip4 := ip.To4(); ip4 != nil {
 		// IPv4: Set last octet to 0
-		parts := strings.Split(ipStr, ".")
+		parts := strings.Split(ip4.String(), ".")
 		if len(parts) == 4 {
 			parts[3] = "0"
 			return strings.Join(parts, ".")
@@ -314,14 +720,32 @@ func anonymizeIP(ipStr string) string {
 	}
 }
 
+// Maximum number of ports per check
+const maxPorts = 5
+
 // Parse ports from query parameter
-func parsePorts(portsParam string) ([]int, error) {
+func parsePorts(portsParam string, key *APIKey) ([]int, error) {
 	if portsParam == "" {
 		return []int{80, 443}, nil // Default ports
 	}
 
 	var ports []int
 	for _, p := range strings.Split(portsParam, ",") {
+		// @name expands a configured port group
+		if name, ok := strings.CutPrefix(strings.TrimSpace(p), "@"); ok {
+			group, exists := config.PortGroups[name]
+			if !exists {
+				return nil, fmt.Errorf("unknown port group: @%s", name)
+			}
+			for _, port := range group {
+				if !portAllowed(key, port) {
+					return nil, fmt.Errorf("port not allowed: %d (in @%s)", port, name)
+				}
+			}
+			ports = mergePorts(ports, group)
+			continue
+		}
+
 		port, err := strconv.Atoi(strings.TrimSpace(p))
 		if err != nil {
 			return nil, fmt.Errorf("invalid port: %s", p)
@@ -329,19 +753,194 @@ func parsePorts(portsParam string) ([]int, error) {
 		if port < 1 || port > 65535 {
 			return nil, fmt.Errorf("port out of range: %d", port)
 		}
-		if !config.AllowedPorts[port] {
+		if !portAllowed(key, port) {
 			return nil, fmt.Errorf("port not allowed: %d", port)
 		}
 		ports = append(ports, port)
 	}
 
-	if len(ports) > 5 {
-		return nil, fmt.Errorf("too many ports (max 5)")
+	if len(ports) > maxPorts {
+		return nil, fmt.Errorf("too many ports (max %d)", maxPorts)
 	}
 
 	return ports, nil
 }
 
+// chainInOrder reports whether every certificate of the presented chain was
+// issued by the one following it. Verification builds its own path, so a
+// chain in the wrong order can still verify while stricter clients fail.
+func chainInOrder(certs []*x509.Certificate) bool {
+	for i := 0; i+1 < len(certs); i++ {
+		if certs[i].CheckSignatureFrom(certs[i+1]) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// TLS warnings that make a certificate unfit for https_check. Advance
+// notices like certificate_expires_soon and no_sct do not count.
+var unhealthyCertWarnings = map[string]bool{
+	"certificate_expired":          true,
+	"certificate_expires_critical": true,
+	"certificate_not_yet_valid":    true,
+	"self_signed_certificate":      true,
+	"missing_san":                  true,
+}
+
+// httpsVerdict combines the TCP, handshake and certificate checks of a
+// port 443 result and lists the ones that failed
+func httpsVerdict(result PortResult) (bool, []string) {
+	if !result.Reachable {
+		return false, []string{"tcp_unreachable"}
+	}
+	if result.TLS == nil {
+		return false, []string{"tls_handshake_failed"}
+	}
+	var problems []string
+	if !result.TLS.ChainValid {
+		problems = append(problems, "chain_invalid")
+	}
+	for _, warning := range result.TLS.Warnings {
+		if unhealthyCertWarnings[warning] {
+			problems = append(problems, warning)
+		}
+	}
+	return len(problems) == 0, problems
+}
+
+// requiresChallenge reports whether ports include one of
+// REFLECTOR_CHALLENGE_REQUIRED_PORTS
+func requiresChallenge(ports []int) bool {
+	for _, port := range ports {
+		if config.ChallengeRequiredPorts[port] {
+			return true
+		}
+	}
+	return false
+}
+
+// resultsList orders results by ports, the order the client asked for
+func resultsList(ports []int, results map[string]PortResult) []PortResultEntry {
+	list := make([]PortResultEntry, 0, len(results))
+	seen := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		result, ok := results[strconv.Itoa(port)]
+		if !ok || seen[port] {
+			continue
+		}
+		seen[port] = true
+		list = append(list, PortResultEntry{Port: port, PortResult: result})
+	}
+	return list
+}
+
+// portGroupsIn returns the configured port groups referenced in portsParam
+func portGroupsIn(portsParam string) map[string][]int {
+	var groups map[string][]int
+	for _, p := range strings.Split(portsParam, ",") {
+		if name, ok := strings.CutPrefix(strings.TrimSpace(p), "@"); ok {
+			if group, exists := config.PortGroups[name]; exists {
+				if groups == nil {
+					groups = make(map[string][]int)
+				}
+				groups[name] = group
+			}
+		}
+	}
+	return groups
+}
+
+// parsePortGroups parses REFLECTOR_PORT_GROUPS, a JSON object mapping group
+// names to port lists, e.g. {"web":[80,443],"mail":[25,587,993]}
+func parsePortGroups(s string) (map[string][]int, error) {
+	var groups map[string][]int
+	if err := json.Unmarshal([]byte(s), &groups); err != nil {
+		return nil, err
+	}
+	for name, ports := range groups {
+		if name == "" || strings.ContainsAny(name, ",@") {
+			return nil, fmt.Errorf("invalid group name: %q", name)
+		}
+		for _, port := range ports {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("group %s: invalid port %d", name, port)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// mergePorts appends the ports of extra that are not already in ports
+func mergePorts(ports, extra []int) []int {
+	for _, port := range extra {
+		if !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// failedConditions returns the require= conditions not met by results
+func failedConditions(require []string, results map[string]PortResult) []string {
+	var failed []string
+	for _, cond := range require {
+		ok, seen := true, false
+		for _, result := range results {
+			switch cond {
+			case "tcp":
+				seen = true
+				ok = ok && result.Reachable
+			case "tls_valid":
+				if result.TLS != nil {
+					seen = true
+					ok = ok && result.TLS.ChainValid
+				}
+			case "challenge":
+				if result.Challenge != nil {
+					seen = true
+					ok = ok && result.Challenge.Verified
+				}
+			case "http_2xx":
+				if result.HTTPStatus != 0 || result.HTTPError != "" {
+					seen = true
+					ok = ok && result.HTTPHealthy
+				}
+			}
+		}
+		if !ok || !seen {
+			failed = append(failed, cond)
+		}
+	}
+	return failed
+}
+
+// Well-known service names (IANA) for common ports
+var serviceNames = map[int]string{
+	21:    "ftp",
+	22:    "ssh",
+	23:    "telnet",
+	25:    "smtp",
+	53:    "domain",
+	80:    "http",
+	110:   "pop3",
+	143:   "imap",
+	443:   "https",
+	465:   "submissions",
+	587:   "submission",
+	993:   "imaps",
+	995:   "pop3s",
+	1194:  "openvpn",
+	1883:  "mqtt",
+	3306:  "mysql",
+	3389:  "ms-wbt-server",
+	5432:  "postgresql",
+	8080:  "http-alt",
+	8443:  "https-alt",
+	8883:  "secure-mqtt",
+	51820: "wireguard",
+}
+
 // Format host:port correctly for IPv6 addresses
 func formatHostPort(host string, port int) string {
 	// If host contains colons (IPv6), wrap it in brackets
@@ -351,65 +950,386 @@ func formatHostPort(host string, port int) string {
 	return fmt.Sprintf("%s:%d", host, port)
 }
 
+// asciiHostname converts a possibly internationalized hostname to its
+// ASCII (punycode) form
+func asciiHostname(name string) (string, error) {
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if err != nil || ascii == "" {
+		return "", fmt.Errorf("invalid hostname: %s", name)
+	}
+	return ascii, nil
+}
+
+// unicodeHostname returns the Unicode form of an ASCII hostname
+func unicodeHostname(name string) string {
+	if unicode, err := idna.Lookup.ToUnicode(name); err == nil {
+		return unicode
+	}
+	return name
+}
+
+// Outbound connections
+var resolver = net.DefaultResolver
+
+// newResolver returns a resolver that sends all queries to address
+// (host or host:port, port 53 by default)
+func newResolver(address string) *net.Resolver {
+	address = withDNSPort(address)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: config.Timeout}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// newDialer returns a dialer for outbound probes using the configured
+// resolver, tunneling through the upstream proxy if one is configured
+func newDialer(timeout time.Duration) Dialer {
+	if upstreamProxy != nil {
+		return upstreamProxy.withTimeout(timeout)
+	}
+	return &net.Dialer{
+		Timeout:  timeout,
+		Resolver: resolver,
+	}
+}
+
+// newTransport returns an HTTP transport for outbound probes. It dials with
+// newDialer, skips certificate verification and ignores proxy settings from
+// the environment.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:       newDialer(config.Timeout).DialContext,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}
+}
+
+// How long in-flight requests get to finish on SIGINT/SIGTERM
+const shutdownGracePeriod = 30 * time.Second
+
+// How long to wait for an immediate RST after connecting
+const resetProbeWait = 200 * time.Millisecond
+
+// resetAfterConnect does a short read on a fresh connection and reports
+// whether the peer reset it, as some firewalls do right after the handshake.
+// Data that arrives is consumed, so it is only used before TLS analysis.
+func resetAfterConnect(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(resetProbeWait))
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := conn.Read(make([]byte, 1))
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
 // TCP port check
 func checkPort(ctx context.Context, host string, port int) (bool, int64, error) {
-	start := time.Now()
-	
-	dialer := &net.Dialer{
-		Timeout: config.Timeout,
-	}
-	
-	conn, err := dialer.DialContext(ctx, "tcp", formatHostPort(host, port))
+	conn, latency, err := dialPort(ctx, host, port)
 	if err != nil {
 		return false, 0, err
 	}
-	defer conn.Close()
-	
-	latency := time.Since(start).Milliseconds()
+	conn.Close()
 	return true, latency, nil
 }
 
-// TLS analysis
-func analyzeTLS(host string, port int) (*TLSInfo, error) {
-	dialer := &net.Dialer{Timeout: config.Timeout}
-	
-	conn, err := tls.DialWithDialer(dialer, "tcp",
-		formatHostPort(host, port),
-		&tls.Config{InsecureSkipVerify: true})
+// errHostnameTarget is returned when a hostname reaches the dialer. Only
+// literal IPs are dialed, so a name can never resolve to an internal address.
+var errHostnameTarget = errors.New("hostname targets are not supported")
+
+// dialPort connects to host:port and returns the open connection along with
+// the connect latency. The caller must close the connection. host must be a
+// literal IP; anything else fails with errHostnameTarget.
+func dialPort(ctx context.Context, host string, port int) (net.Conn, int64, error) {
+	if net.ParseIP(host) == nil {
+		return nil, 0, errHostnameTarget
+	}
+	start := time.Now()
+
+	conn, err := newDialer(config.Timeout).DialContext(ctx, "tcp", formatHostPort(host, port))
 	if err != nil {
+		return nil, 0, err
+	}
+
+	latency := time.Since(start).Milliseconds()
+	return conn, latency, nil
+}
+
+// isResourceExhausted reports whether err was caused by the server running out
+// of file descriptors rather than by the remote end.
+func isResourceExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// reportResourceExhausted logs a file descriptor exhaustion and marks the
+// server as degraded for resourceExhaustedWindow
+func reportResourceExhausted(port int, err error) {
+	lastResourceExhausted.Store(time.Now().Unix())
+	logger.LogError("error", "file descriptor limit reached", map[string]interface{}{
+		"port":  port,
+		"error": err.Error(),
+	})
+}
+
+// TLSProbeOptions controls how analyzeTLS negotiates with the remote end
+type TLSProbeOptions struct {
+	MinVersion         uint16
+	MaxVersion         uint16
+	ServerName         string // ASCII form, sent as SNI
+	Resumption         bool   // probe session resumption with a second handshake
+	ChainPEM           bool   // return the presented chain as PEM
+	ExpiryWarnDays     int    // certificate_expires_soon threshold
+	ExpiryCriticalDays int    // certificate_expires_critical threshold, 0 = off
+	MozillaTrust       bool   // also verify the chain against the Mozilla roots
+	MinAcceptable      uint16 // lowest version not flagged as weak_tls_version
+}
+
+// Upper bound for the expiry_warn_days and expiry_critical_days thresholds
+const maxExpiryDays = 3650
+
+// Upper bound for TLSInfo.ChainPEM; certificates beyond it are left out
+const maxChainPEMBytes = 32 << 10
+
+// How long to wait for TLS 1.3 session tickets before reconnecting
+const resumptionTicketWait = 500 * time.Millisecond
+
+// parseTLSVersion converts "1.0" ... "1.3" into a crypto/tls version constant
+func parseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid TLS version: %s", s)
+	}
+}
+
+// errorCode returns code, followed by the underlying error when
+// REFLECTOR_DEBUG is on. The raw message can reveal internals (addresses,
+// proxy details), so it is never included otherwise.
+func errorCode(code string, err error) string {
+	if config.Debug && err != nil {
+		return code + ": " + err.Error()
+	}
+	return code
+}
+
+// errNoCertificates is returned when the server completes the handshake
+// without presenting a certificate
+var errNoCertificates = errors.New("no certificates received")
+
+// classifyTLSError turns a failed analyzeTLS into a short error code: the
+// alert the server sent (e.g. handshake_failure, protocol_version), or what
+// went wrong on the wire
+func classifyTLSError(err error) string {
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		// The alert type is not exported; its text is "tls: <description>"
+		alert := strings.TrimPrefix(opErr.Err.Error(), "tls: ")
+		if alert == "protocol version not supported" {
+			return "protocol_version"
+		}
+		return strings.ReplaceAll(alert, " ", "_")
+	case errors.As(err, &recordErr):
+		// The server answered with something other than a TLS record
+		return "no_tls_on_port"
+	case errors.Is(err, errNoCertificates):
+		return "no_certificate"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "handshake_timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, syscall.ECONNRESET):
+		return "connection_closed"
+	case strings.Contains(err.Error(), "unsupported protocol version"):
+		return "protocol_version"
+	default:
+		return "handshake_failed"
+	}
+}
+
+// TLS analysis over an already established TCP connection. The handshake is
+// performed on conn, which remains owned by the caller.
+func analyzeTLS(conn net.Conn, opts TLSProbeOptions) (*TLSInfo, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         opts.MinVersion,
+		MaxVersion:         opts.MaxVersion,
+		ServerName:         opts.ServerName,
+	}
+	// Legacy endpoints rarely speak the modern default suites, so offer
+	// everything when deliberately probing below TLS 1.2.
+	if opts.MinVersion != 0 && opts.MinVersion < tls.VersionTLS12 {
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite.ID)
+		}
+	}
+	if opts.Resumption {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(config.Timeout))
+	handshakeStart := time.Now()
+	if err := tlsConn.Handshake(); err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	handshakeMs := time.Since(handshakeStart).Milliseconds()
 
-	state := conn.ConnectionState()
+	state := tlsConn.ConnectionState()
 	if len(state.PeerCertificates) == 0 {
-		return nil, fmt.Errorf("no certificates received")
+		return nil, errNoCertificates
 	}
-	
+
 	cert := state.PeerCertificates[0]
 
 	info := &TLSInfo{
 		Version:     tlsVersionName(state.Version),
 		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
 		ChainLength: len(state.PeerCertificates),
+		HandshakeMs: handshakeMs,
 		Certificate: CertInfo{
 			Subject:         cert.Subject.CommonName,
 			Issuer:          cert.Issuer.CommonName,
 			SelfSigned:      cert.Subject.String() == cert.Issuer.String(),
-			NotBefore:       cert.NotBefore.Format(time.RFC3339),
-			NotAfter:        cert.NotAfter.Format(time.RFC3339),
+			NotBefore:       formatTimestamp(cert.NotBefore),
+			NotAfter:        formatTimestamp(cert.NotAfter),
 			DaysUntilExpiry: int(time.Until(cert.NotAfter).Hours() / 24),
 			DNSNames:        cert.DNSNames,
 			Serial:          cert.SerialNumber.Text(16),
+			// Authority Information Access and CRL locations
+			IssuingCertURLs:       cert.IssuingCertificateURL,
+			OCSPServers:           cert.OCSPServer,
+			CRLDistributionPoints: cert.CRLDistributionPoints,
+			PolicyOIDs:            certPolicies(cert),
 		},
 	}
+	// Self-signed certificates were not validated by anyone
+	if !info.Certificate.SelfSigned {
+		info.Certificate.ValidationLevel = validationLevel(cert, info.Certificate.PolicyOIDs)
+	}
+
+	if opts.ServerName != "" {
+		info.SNI = opts.ServerName
+		if unicode := unicodeHostname(opts.ServerName); unicode != opts.ServerName {
+			info.SNIUnicode = unicode
+		}
+	}
+
+	// Verify the chain against the system roots, and the name if SNI was given
+	verifyOpts := x509.VerifyOptions{
+		DNSName:       opts.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, intermediate := range state.PeerCertificates[1:] {
+		verifyOpts.Intermediates.AddCert(intermediate)
+	}
+	_, err := cert.Verify(verifyOpts)
+	info.ChainValid = err == nil
+	if opts.MozillaTrust {
+		trusted := verifyMozillaTrust(cert, verifyOpts)
+		info.TrustedByMozilla = &trusted
+	}
 
 	// Generate warnings
-	info.Warnings = generateTLSWarnings(state.Version, cert)
+	info.Warnings = generateTLSWarnings(state.Version, cert, opts)
+	info.SCTCount = countSCTs(cert) + len(state.SignedCertificateTimestamps)
+	if info.SCTCount == 0 {
+		info.Warnings = append(info.Warnings, "no_sct")
+	}
+	info.CipherGrade = cipherGrade(info.CipherSuite)
+	if info.CipherGrade == "weak" {
+		info.Warnings = append(info.Warnings, "weak_cipher")
+	}
+	if !chainInOrder(state.PeerCertificates) {
+		info.Warnings = append(info.Warnings, "chain_out_of_order")
+	}
+
+	if opts.ChainPEM {
+		info.ChainPEM, info.ChainPEMTruncated = encodeChainPEM(state.PeerCertificates)
+	}
+
+	if opts.Resumption {
+		resumed := probeResumption(tlsConn, tlsConfig)
+		info.TLSResumption = &resumed
+	}
 
 	return info, nil
 }
 
+// Certificate Transparency: embedded SCT list extension (RFC 6962)
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// countSCTs returns the number of Signed Certificate Timestamps embedded in
+// cert. The extension holds an OCTET STRING with a TLS-encoded list of
+// length-prefixed SCTs.
+func countSCTs(cert *x509.Certificate) int {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSCTList) {
+			continue
+		}
+		var list []byte
+		if _, err := asn1.Unmarshal(ext.Value, &list); err != nil || len(list) < 2 {
+			return 0
+		}
+		list = list[2:] // total length
+		count := 0
+		for len(list) >= 2 {
+			n := int(list[0])<<8 | int(list[1])
+			if len(list) < 2+n {
+				break
+			}
+			list = list[2+n:]
+			count++
+		}
+		return count
+	}
+	return 0
+}
+
+// encodeChainPEM encodes certs as PEM blocks up to maxChainPEMBytes and
+// reports whether certificates had to be left out
+func encodeChainPEM(certs []*x509.Certificate) (string, bool) {
+	var buf strings.Builder
+	for _, cert := range certs {
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if buf.Len()+len(block) > maxChainPEMBytes {
+			return buf.String(), true
+		}
+		buf.Write(block)
+	}
+	return buf.String(), false
+}
+
+// probeResumption reconnects with the session cached by first and reports
+// whether the server resumed it
+func probeResumption(first *tls.Conn, tlsConfig *tls.Config) bool {
+	// TLS 1.3 tickets are sent after the handshake and only processed on read
+	if first.ConnectionState().Version == tls.VersionTLS13 {
+		first.SetReadDeadline(time.Now().Add(resumptionTicketWait))
+		first.Read(make([]byte, 1))
+	}
+
+	conn, err := newDialer(config.Timeout).Dial("tcp", first.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	second := tls.Client(conn, tlsConfig)
+	second.SetDeadline(time.Now().Add(config.Timeout))
+	if err := second.Handshake(); err != nil {
+		return false
+	}
+	return second.ConnectionState().DidResume
+}
+
 func tlsVersionName(version uint16) string {
 	switch version {
 	case tls.VersionTLS10:
@@ -425,11 +1345,36 @@ func tlsVersionName(version uint16) string {
 	}
 }
 
-func generateTLSWarnings(version uint16, cert *x509.Certificate) []string {
+// Cipher suite name fragments and the grade they imply, checked in order.
+// Suites matching nothing (AEAD with forward secrecy, TLS 1.3) are strong.
+var cipherGrades = []struct {
+	fragment string
+	grade    string
+}{
+	{"_NULL_", "weak"},
+	{"EXPORT", "weak"},
+	{"_RC4_", "weak"},
+	{"_3DES_", "weak"},
+	{"_DES_", "weak"},
+	{"_CBC_", "acceptable"},
+	{"TLS_RSA_", "acceptable"}, // no forward secrecy
+}
+
+// cipherGrade classifies a cipher suite as strong, acceptable or weak
+func cipherGrade(name string) string {
+	for _, g := range cipherGrades {
+		if strings.Contains(name, g.fragment) {
+			return g.grade
+		}
+	}
+	return "strong"
+}
+
+func generateTLSWarnings(version uint16, cert *x509.Certificate, opts TLSProbeOptions) []string {
 	var warnings []string
 
 	// Check TLS version
-	if version == tls.VersionTLS10 || version == tls.VersionTLS11 {
+	if version < opts.MinAcceptable {
 		warnings = append(warnings, "weak_tls_version")
 	}
 
@@ -438,11 +1383,13 @@ func generateTLSWarnings(version uint16, cert *x509.Certificate) []string {
 		warnings = append(warnings, "self_signed_certificate")
 	}
 
-	// Check certificate expiration
+	// Check certificate expiration; only the most urgent warning is given
 	now := time.Now()
 	if cert.NotAfter.Before(now) {
 		warnings = append(warnings, "certificate_expired")
-	} else if cert.NotAfter.Before(now.AddDate(0, 0, 30)) {
+	} else if opts.ExpiryCriticalDays > 0 && cert.NotAfter.Before(now.AddDate(0, 0, opts.ExpiryCriticalDays)) {
+		warnings = append(warnings, "certificate_expires_critical")
+	} else if cert.NotAfter.Before(now.AddDate(0, 0, opts.ExpiryWarnDays)) {
 		warnings = append(warnings, "certificate_expires_soon")
 	}
 
@@ -458,24 +1405,216 @@ func generateTLSWarnings(version uint16, cert *x509.Certificate) []string {
 	return warnings
 }
 
-// Challenge verification
-func verifyChallenge(host string, port int, token, path string) *ChallengeRes {
-	if path == "" {
-		path = fmt.Sprintf("/.well-known/reflector/%s", token)
-	}
-
-	url := fmt.Sprintf("http://%s:%d%s", host, port, path)
-	
-	client := &http.Client{
-		Timeout: config.Timeout,
+// checkDeadline returns the overall time budget of a /check: the
+// X-Check-Timeout header (a duration or seconds) clamped to
+// config.MaxCheckDuration, which is also the default. Malformed values are
+// ignored.
+func checkDeadline(r *http.Request) time.Duration {
+	v := r.Header.Get("X-Check-Timeout")
+	if v == "" {
+		return config.MaxCheckDuration
 	}
-	
-	resp, err := client.Get(url)
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		return &ChallengeRes{
-			Verified: false,
-			Error:    "http_error",
-			Expected: token,
+		secs, convErr := strconv.ParseFloat(v, 64)
+		if convErr != nil {
+			return config.MaxCheckDuration
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return config.MaxCheckDuration
+	}
+	return min(d, config.MaxCheckDuration)
+}
+
+// Challenge verification
+const (
+	maxChallengeTimeout = 10 * time.Second
+	maxChallengeEcho    = 256
+)
+
+// parseChallengeTimeout accepts a Go duration ("3s") or a number of seconds
+// and clamps it to maxChallengeTimeout
+func parseChallengeTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, convErr := strconv.ParseFloat(s, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid challenge_timeout: %s", s)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("challenge_timeout must be positive")
+	}
+	return min(d, maxChallengeTimeout), nil
+}
+
+// ChallengeOptions describes a challenge requested by the client
+type ChallengeOptions struct {
+	Token   string
+	Path    string
+	Port    int
+	Timeout time.Duration
+	Host    string // ASCII form, sent as Host header; empty uses the IP
+	Match   string // "exact" (default) or "contains"
+	Scheme  string // "http" or "https"
+}
+
+// challengeTargetAllowed reports whether a challenge may be fetched from ip
+// with hostname as Host header. ip is always the caller's address; the
+// optional allowlists narrow this further to the configured networks and
+// hostnames, so the challenge cannot be pointed at arbitrary virtual hosts.
+func challengeTargetAllowed(ip, hostname string) bool {
+	if len(config.ChallengeAllowedCIDRs) > 0 && !containsIP(config.ChallengeAllowedCIDRs, net.ParseIP(ip)) {
+		return false
+	}
+	if hostname == "" || len(config.ChallengeAllowedHosts) == 0 {
+		return true
+	}
+	hostname = strings.ToLower(hostname)
+	for _, allowed := range config.ChallengeAllowedHosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(hostname, "."+suffix) {
+				return true
+			}
+		} else if hostname == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyChallenge(host string, opts ChallengeOptions) *ChallengeRes {
+	return verifyChallengeWith(newTransport(), host, opts)
+}
+
+// verifyChallengeOn sends the challenge request over conn, the open
+// connection of the port check, which saves connecting again. If that
+// connection fails, e.g. because the server closed it, the challenge is
+// fetched over a new one.
+func verifyChallengeOn(conn net.Conn, host string, opts ChallengeOptions) *ChallengeRes {
+	transport := newTransport()
+	dial := transport.DialContext
+	var reused atomic.Bool
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		// Redirects to another port connect normally
+		if !reused.Swap(true) {
+			return conn, nil
+		}
+		return dial(ctx, network, address)
+	}
+
+	res := verifyChallengeWith(transport, host, opts)
+	if res.Error == "http_error" {
+		return verifyChallenge(host, opts)
+	}
+	res.ConnectionReused = true
+	return res
+}
+
+func verifyChallengeWith(transport *http.Transport, host string, opts ChallengeOptions) *ChallengeRes {
+	token, path, port := opts.Token, opts.Path, opts.Port
+	if !challengeTargetAllowed(host, opts.Host) {
+		return &ChallengeRes{
+			Verified: false,
+			Error:    "challenge_target_not_allowed",
+			Expected: token,
+			Host:     opts.Host,
+		}
+	}
+	if path == "" {
+		path = fmt.Sprintf("/.well-known/reflector/%s", token)
+	}
+
+	url := fmt.Sprintf("%s://%s%s", opts.Scheme, formatHostPort(host, port), path)
+
+	client := &http.Client{
+		Timeout:       opts.Timeout,
+		Transport:     transport,
+		CheckRedirect: challengeRedirectPolicy(host, opts.Host),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return &ChallengeRes{
+			Verified: false,
+			Error:    "invalid_request",
+			Expected: token,
+		}
+	}
+	if opts.Host != "" {
+		req.Host = opts.Host
+	}
+	req.Header.Set("User-Agent", config.UserAgent)
+	// Lets origins and middleboxes recognize the verification request. It
+	// must not carry the token, or an origin echoing headers would pass.
+	req.Header.Set("X-Reflector-Challenge", "1")
+
+	res := fetchChallenge(client, req, token, opts.Match)
+	if opts.Host != "" {
+		res.Host = opts.Host
+		if unicode := unicodeHostname(opts.Host); unicode != opts.Host {
+			res.HostUnicode = unicode
+		}
+	}
+	return res
+}
+
+// Redirect policy errors of the challenge fetch
+var (
+	errChallengeTooManyRedirects = errors.New("too many challenge redirects")
+	errChallengeRedirectBlocked  = errors.New("challenge redirect leaves the target")
+)
+
+// challengeRedirectPolicy follows at most REFLECTOR_CHALLENGE_MAX_REDIRECTS
+// redirects, and only those that stay on host (the client's IP) or name
+// hostname, the challenge_host. Redirects to the name keep connecting to
+// host, so a redirect can never make the reflector fetch from elsewhere.
+func challengeRedirectPolicy(host, hostname string) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > config.ChallengeMaxRedirects {
+			return errChallengeTooManyRedirects
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errChallengeRedirectBlocked
+		}
+		target := req.URL.Hostname()
+		if hostname != "" && strings.EqualFold(target, hostname) {
+			port := req.URL.Port()
+			if port == "" {
+				port = "80"
+				if req.URL.Scheme == "https" {
+					port = "443"
+				}
+			}
+			req.Host = req.URL.Host
+			req.URL.Host = net.JoinHostPort(host, port)
+			return nil
+		}
+		if ip := net.ParseIP(target); ip == nil || !ip.Equal(net.ParseIP(host)) || isPrivateIP(ip) {
+			return errChallengeRedirectBlocked
+		}
+		return nil
+	}
+}
+
+// fetchChallenge performs the challenge request and compares the body to token
+func fetchChallenge(client *http.Client, req *http.Request, token, match string) *ChallengeRes {
+	resp, err := client.Do(req)
+	if err != nil {
+		code := "http_error"
+		switch {
+		case errors.Is(err, errChallengeTooManyRedirects):
+			code = "too_many_redirects"
+		case errors.Is(err, errChallengeRedirectBlocked):
+			code = "redirect_blocked"
+		}
+		return &ChallengeRes{
+			Verified: false,
+			Error:    code,
+			Expected: token,
 		}
 	}
 	defer resp.Body.Close()
@@ -488,7 +1627,7 @@ func verifyChallenge(host string, port int, token, path string) *ChallengeRes {
 		}
 	}
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	body, err := io.ReadAll(io.LimitReader(resp.Body, config.ChallengeMaxBytes))
 	if err != nil {
 		return &ChallengeRes{
 			Verified: false,
@@ -498,13 +1637,18 @@ func verifyChallenge(host string, port int, token, path string) *ChallengeRes {
 	}
 
 	received := strings.TrimSpace(string(body))
-	if received == token {
+	if received == token || (match == "contains" && strings.Contains(received, token)) {
 		return &ChallengeRes{
 			Verified: true,
 			Token:    token,
 		}
 	}
 
+	// Only echo the start of large documents
+	if len(received) > maxChallengeEcho {
+		received = received[:maxChallengeEcho] + "..."
+	}
+
 	return &ChallengeRes{
 		Verified: false,
 		Error:    "token_mismatch",
@@ -513,29 +1657,264 @@ func verifyChallenge(host string, port int, token, path string) *ChallengeRes {
 	}
 }
 
+// HTTP health probe
+const (
+	httpProbeMaxRedirects = 3
+	httpProbeMaxBody      = 64 * 1024
+	httpProbeMaxPath      = 256
+)
+
+// httpScheme returns the scheme spoken on well-known web ports, or "" if the
+// port is not a web port.
+func httpScheme(port int) string {
+	switch port {
+	case 80, 8080:
+		return "http"
+	case 443, 8443:
+		return "https"
+	default:
+		return ""
+	}
+}
+
+// probeHTTPSRedirect requests / on port 80 and reports whether the answer
+// is a redirect to HTTPS, with its target. Only the first response is
+// inspected; the redirect is never followed, so the client's server cannot
+// point the reflector at other hosts.
+func probeHTTPSRedirect(host string) (bool, string, error) {
+	client := &http.Client{
+		Timeout:   config.Timeout,
+		Transport: newTransport(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+formatHostPort(host, 80)+"/", nil)
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("User-Agent", config.UserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, httpProbeMaxBody))
+
+	if resp.StatusCode < 300 || resp.StatusCode > 399 {
+		return false, "", nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return false, "", nil
+	}
+	return location.Scheme == "https", location.String(), nil
+}
+
+// probeHTTPPath issues a GET for path and returns the final status code.
+// Redirects are only followed on the same host and the body is drained up to
+// httpProbeMaxBody bytes.
+func probeHTTPPath(host string, port int, path string) (int, int64, error) {
+	url := fmt.Sprintf("%s://%s%s", httpScheme(port), formatHostPort(host, port), path)
+
+	client := &http.Client{
+		Timeout:   config.Timeout,
+		Transport: newTransport(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > httpProbeMaxRedirects || req.URL.Hostname() != host {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", config.UserAgent)
+
+	// Time to first byte of the first response, excluding connect and TLS
+	var wrote, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			if wrote.IsZero() {
+				wrote = time.Now()
+			}
+		},
+		GotFirstResponseByte: func() {
+			if firstByte.IsZero() {
+				firstByte = time.Now()
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, httpProbeMaxBody))
+	return resp.StatusCode, firstByte.Sub(wrote).Milliseconds(), nil
+}
+
+// probeHTTPOptions sends OPTIONS * to a web port and, if that does not
+// name any methods, OPTIONS /. It returns the status of the last response
+// and the methods of its Allow header, upper-cased and deduplicated.
+// Redirects are not followed.
+func probeHTTPOptions(host string, port int) (int, []string, error) {
+	client := &http.Client{
+		Timeout:   config.Timeout,
+		Transport: newTransport(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	url := fmt.Sprintf("%s://%s", httpScheme(port), formatHostPort(host, port))
+	var status int
+	var methods []string
+	for _, target := range []string{"*", "/"} {
+		req, err := http.NewRequest(http.MethodOptions, url, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		// An opaque "*" is sent as the request target as is
+		req.URL.Opaque = target
+		req.Header.Set("User-Agent", config.UserAgent)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, httpProbeMaxBody))
+		resp.Body.Close()
+
+		status = resp.StatusCode
+		methods = parseAllowHeader(resp.Header.Values("Allow"))
+		if len(methods) > 0 {
+			break
+		}
+	}
+	return status, methods, nil
+}
+
+// parseAllowHeader splits Allow header values into method names
+func parseAllowHeader(values []string) []string {
+	var methods []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, method := range strings.Split(value, ",") {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if method != "" && !seen[method] {
+				seen[method] = true
+				methods = append(methods, method)
+			}
+		}
+	}
+	return methods
+}
+
 // Banner grabbing
+const maxBannerProbeLen = 512
+
+// parseBannerProbes parses a JSON object mapping ports to probe payloads,
+// e.g. {"6379": "PING\r\n"}. JSON string escapes (\r, \n, \u0000) can be
+// used for non-printable bytes.
+func parseBannerProbes(s string) (map[int][]byte, error) {
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, err
+	}
+
+	probes := make(map[int][]byte, len(raw))
+	for p, probe := range raw {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port: %s", p)
+		}
+		if len(probe) > maxBannerProbeLen {
+			return nil, fmt.Errorf("probe for port %d exceeds %d bytes", port, maxBannerProbeLen)
+		}
+		probes[port] = []byte(probe)
+	}
+	return probes, nil
+}
+
 func grabBanner(host string, port int) string {
-	conn, err := net.DialTimeout("tcp", formatHostPort(host, port), 2*time.Second)
+	conn, err := newDialer(config.BannerConnectTimeout).Dial("tcp", formatHostPort(host, port))
 	if err != nil {
 		return ""
 	}
 	defer conn.Close()
 
-	// Send a simple HTTP request for web ports
-	if port == 80 || port == 8080 {
-		fmt.Fprintf(conn, "HEAD / HTTP/1.0\r\nHost: %s\r\n\r\n", host)
+	// Send the configured probe, or a simple HTTP request for web ports.
+	// HTTP/1.1 is offered so the status line reveals the highest version the
+	// server speaks.
+	if probe, ok := config.BannerProbes[port]; ok {
+		conn.SetWriteDeadline(time.Now().Add(config.BannerReadTimeout))
+		conn.Write(probe)
+	} else if port == 80 || port == 8080 {
+		fmt.Fprintf(conn, "HEAD / HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\nConnection: close\r\n\r\n", formatHostPort(host, port), config.UserAgent)
 	}
 
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(config.BannerReadTimeout))
 	buf := make([]byte, 256)
 	n, _ := conn.Read(buf)
-	
+
 	if n > 0 {
 		return sanitizeBanner(string(buf[:n]))
 	}
 	return ""
 }
 
+// speaksHTTP sends a HEAD request over conn, the open connection to a plain
+// HTTP port, and reports whether the answer starts with an HTTP status line.
+// Otherwise it also returns the sanitized start of whatever was sent back.
+func speaksHTTP(conn net.Conn, host string, port int) (bool, string) {
+	conn.SetDeadline(time.Now().Add(config.BannerReadTimeout))
+	defer conn.SetDeadline(time.Time{})
+	fmt.Fprintf(conn, "HEAD / HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\nConnection: close\r\n\r\n", formatHostPort(host, port), config.UserAgent)
+
+	buf := make([]byte, 256)
+	n, _ := conn.Read(buf)
+	response := string(buf[:n])
+	if httpStatusVersion(response) != "" {
+		return true, ""
+	}
+	return false, sanitizeBanner(response)
+}
+
+// httpStatusVersion returns the protocol token (e.g. "HTTP/1.1") of the status
+// line at the start of banner, or "" if banner is not an HTTP response
+func httpStatusVersion(banner string) string {
+	line, _, _ := strings.Cut(banner, "\n")
+	proto, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if strings.HasPrefix(proto, "HTTP/") {
+		return proto
+	}
+	return ""
+}
+
+// parseSSHBanner splits an SSH identification string
+// ("SSH-protoversion-softwareversion SP comments", RFC 4253 section 4.2)
+func parseSSHBanner(banner string) (protocol, software, comment string, ok bool) {
+	rest, found := strings.CutPrefix(banner, "SSH-")
+	if !found {
+		return "", "", "", false
+	}
+	ident, comment, _ := strings.Cut(rest, " ")
+	protocol, software, found = strings.Cut(ident, "-")
+	if !found || protocol == "" {
+		return "", "", "", false
+	}
+	return protocol, software, strings.TrimSpace(comment), true
+}
+
 // sanitizeBanner removes non-printable characters and limits banner length
 func sanitizeBanner(banner string) string {
 	// Check if it's an SSH banner (starts with "SSH-")
@@ -551,14 +1930,14 @@ func sanitizeBanner(banner string) string {
 					cleaned.WriteRune(r)
 				}
 			}
-			result := strings.TrimSpace(cleaned.String())
+			result := redactBanner(strings.TrimSpace(cleaned.String()))
 			if len(result) > 100 {
 				result = result[:100]
 			}
 			return result
 		}
 	}
-	
+
 	// For non-SSH banners, filter out non-printable characters
 	var sanitized strings.Builder
 	for _, r := range banner {
@@ -566,27 +1945,187 @@ func sanitizeBanner(banner string) string {
 			sanitized.WriteRune(r)
 		}
 	}
-	
-	result := sanitized.String()
-	
+
+	result := redactBanner(sanitized.String())
+
 	// Trim whitespace and limit length
 	result = strings.TrimSpace(result)
 	if len(result) > 200 {
 		result = result[:200] + "..."
 	}
-	
+
 	return result
 }
 
+// redactBanner replaces the parts of banner matching
+// REFLECTOR_BANNER_REDACT with [redacted]
+func redactBanner(banner string) string {
+	for _, re := range config.BannerRedact {
+		banner = re.ReplaceAllString(banner, "[redacted]")
+	}
+	return banner
+}
+
+// parseBannerRedact compiles REFLECTOR_BANNER_REDACT, a JSON array of
+// regular expressions
+func parseBannerRedact(s string) ([]*regexp.Regexp, error) {
+	var patterns []string
+	if err := json.Unmarshal([]byte(s), &patterns); err != nil {
+		return nil, err
+	}
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Fields that may be listed in REFLECTOR_REDACT_FIELDS
+var redactableFields = map[string]bool{
+	"client_ip": true,
+	"serial":    true,
+	"dns_names": true,
+	"subject":   true,
+	"issuer":    true,
+	"banner":    true,
+}
+
+// redactResponse zeroes the configured fields so omitempty drops them
+func redactResponse(resp *CheckResponse) {
+	if len(config.RedactFields) == 0 {
+		return
+	}
+	if config.RedactFields["client_ip"] {
+		resp.ClientIP = ""
+		// The block and its addresses include the caller's address
+		resp.CIDR = ""
+		resp.CIDRResults = nil
+		// A traceroute that arrived ends at the caller
+		if resp.Traceroute != nil && resp.Traceroute.Reached && len(resp.Traceroute.Hops) > 0 {
+			trace := *resp.Traceroute
+			trace.Hops = append([]TracerouteHop(nil), trace.Hops...)
+			trace.Hops[len(trace.Hops)-1].IP = ""
+			resp.Traceroute = &trace
+		}
+	}
+	// Results may be shared with coalesced requests, so copy them
+	redacted := make(map[string]PortResult, len(resp.Results))
+	for port, result := range resp.Results {
+		redacted[port] = redactResult(result)
+	}
+	resp.Results = redacted
+	if resp.ResultsList != nil {
+		list := make([]PortResultEntry, len(resp.ResultsList))
+		for i, entry := range resp.ResultsList {
+			list[i] = PortResultEntry{Port: entry.Port, PortResult: redactResult(entry.PortResult)}
+		}
+		resp.ResultsList = list
+	}
+}
+
+// redactResult returns result without the fields in config.RedactFields
+func redactResult(result PortResult) PortResult {
+	if result.TLS != nil {
+		result.TLS = redactTLS(*result.TLS)
+	}
+	if result.SMTP != nil {
+		smtp := *result.SMTP
+		if smtp.TLS != nil {
+			smtp.TLS = redactTLS(*smtp.TLS)
+		}
+		if config.RedactFields["banner"] {
+			smtp.Greeting = ""
+		}
+		result.SMTP = &smtp
+	}
+	if config.RedactFields["banner"] {
+		// The SSH fields are parsed from the banner, and the not_http
+		// sample is banner content as well
+		result.Banner = ""
+		result.SSHSoftware = ""
+		result.SSHComment = ""
+		result.NotHTTPSample = ""
+	}
+	if config.RedactFields["client_ip"] && result.DualStack != nil {
+		dualStack := *result.DualStack
+		dualStack.IPv4.Address = ""
+		dualStack.IPv6.Address = ""
+		result.DualStack = &dualStack
+	}
+	return result
+}
+
+// redactTLS returns a copy of tlsInfo without the redacted certificate fields
+func redactTLS(tlsInfo TLSInfo) *TLSInfo {
+	if config.RedactFields["serial"] {
+		tlsInfo.Certificate.Serial = ""
+	}
+	if config.RedactFields["dns_names"] {
+		tlsInfo.Certificate.DNSNames = nil
+	}
+	if config.RedactFields["subject"] {
+		tlsInfo.Certificate.Subject = ""
+	}
+	if config.RedactFields["issuer"] {
+		tlsInfo.Certificate.Issuer = ""
+	}
+	return &tlsInfo
+}
+
+// writeCheckResponse applies redaction and writes resp with the given status
+func writeCheckResponse(w http.ResponseWriter, r *http.Request, status int, resp CheckResponse) {
+	redactResponse(&resp)
+	resp.SchemaVersion = schemaVersion
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	// pretty=true indents the output for humans using curl
+	if r.URL.Query().Get("pretty") == "true" {
+		enc.SetIndent("", "  ")
+	}
+	encodeResponse(enc, resp)
+}
+
+// rejectCheck writes an error response for a /check request and records it
+// in the access log
+func rejectCheck(w http.ResponseWriter, r *http.Request, start time.Time, clientIP string, status int, resp CheckResponse) {
+	resp.Success = false
+	resp.Timestamp = formatTimestamp(time.Now())
+	if net.ParseIP(clientIP) != nil {
+		resp.ClientIP = clientIP
+	}
+	// Rejections carry the deprecation warnings of the request too
+	resp.Warnings = deprecationWarnings(r.URL.Query())
+	writeCheckResponse(w, r, status, resp)
+	if doNotLog(r) {
+		return
+	}
+	logger.LogAccess(AccessLogEntry{
+		Timestamp:  resp.Timestamp,
+		IP:         clientIP,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		DurationMs: time.Since(start).Milliseconds(),
+		Status:     status,
+		Error:      resp.Error,
+		Scheme:     requestScheme(r),
+		Query:      loggedQuery(r),
+	})
+}
+
 // HTTP Handlers
 func handleCheck(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	clientIP := getClientIP(r)
-	
+
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Check-Timeout, X-Do-Not-Log")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Check-Duration-Ms, X-Ports-Checked, X-Ports-Skipped, X-Quota-Limit, X-Quota-Remaining")
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method == "OPTIONS" {
@@ -594,24 +2133,37 @@ func handleCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if maintenance.Load() {
+		setRetryAfter(w)
+		rejectCheck(w, r, start, clientIP, http.StatusServiceUnavailable, CheckResponse{
+			Error:   "maintenance",
+			Message: config.MaintenanceMessage,
+		})
+		return
+	}
+
 	// Rate limiting
-	if !rateLimiter.GetLimiter(clientIP).Allow() {
-		w.WriteHeader(http.StatusTooManyRequests)
-		json.NewEncoder(w).Encode(CheckResponse{
-			Success:   false,
-			ClientIP:  clientIP,
-			Timestamp: time.Now().UTC().Format(time.RFC3339),
-			Error:     "rate_limit_exceeded",
-			Message:   "Too many requests. Please try again later.",
+	if !rateLimitExempt(r) && !rateLimiter.GetLimiter(clientIP).Allow() {
+		rejectCheck(w, r, start, clientIP, http.StatusTooManyRequests, CheckResponse{
+			Error:   "rate_limit_exceeded",
+			Message: "Too many requests. Please try again later.",
 		})
-		logger.LogAccess(AccessLogEntry{
-			Timestamp:  time.Now().UTC().Format(time.RFC3339),
-			IP:         clientIP,
-			Method:     r.Method,
-			Path:       r.URL.Path,
-			DurationMs: time.Since(start).Milliseconds(),
-			Status:     http.StatusTooManyRequests,
-			Error:      "rate_limit_exceeded",
+		return
+	}
+
+	// API key authentication and daily quota
+	apiKey, err := authenticate(r)
+	if err != nil {
+		rejectCheck(w, r, start, clientIP, http.StatusUnauthorized, CheckResponse{
+			Error:   "invalid_api_key",
+			Message: "The supplied API key is not valid",
+		})
+		return
+	}
+	if !checkQuota(w, apiKey) {
+		rejectCheck(w, r, start, clientIP, http.StatusTooManyRequests, CheckResponse{
+			Error:   "quota_exceeded",
+			Message: "Daily quota for this API key exhausted. Please try again later.",
 		})
 		return
 	}
@@ -619,110 +2171,697 @@ func handleCheck(w http.ResponseWriter, r *http.Request) {
 	// Parse and validate client IP
 	ip := net.ParseIP(clientIP)
 	if ip == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(CheckResponse{
-			Success:   false,
-			Timestamp: time.Now().UTC().Format(time.RFC3339),
-			Error:     "invalid_ip",
-			Message:   "Could not determine client IP",
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_ip",
+			Message: "Could not determine client IP",
 		})
 		return
 	}
 
 	// Check for private IP
-	if isPrivateIP(ip) {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(CheckResponse{
-			Success:   false,
-			ClientIP:  clientIP,
-			Timestamp: time.Now().UTC().Format(time.RFC3339),
-			Error:     "private_ip",
-			Message:   "Cannot test private/internal IP addresses",
-		})
-		logger.LogAccess(AccessLogEntry{
-			Timestamp:  time.Now().UTC().Format(time.RFC3339),
-			IP:         clientIP,
-			Method:     r.Method,
-			Path:       r.URL.Path,
-			DurationMs: time.Since(start).Milliseconds(),
-			Status:     http.StatusForbidden,
-			Error:      "private_ip",
+	if matchedRange, private := matchPrivateRange(ip); private {
+		rejectCheck(w, r, start, clientIP, http.StatusForbidden, CheckResponse{
+			Error:        "private_ip",
+			Message:      fmt.Sprintf("Cannot test private/internal IP addresses (%s)", matchedRange),
+			MatchedRange: matchedRange,
 		})
 		return
 	}
 
 	// Parse query parameters
 	query := r.URL.Query()
-	ports, err := parsePorts(query.Get("ports"))
+	warnings := deprecationWarnings(query)
+	ports, err := parsePorts(query.Get("ports"), apiKey)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(CheckResponse{
-			Success:   false,
-			ClientIP:  clientIP,
-			Timestamp: time.Now().UTC().Format(time.RFC3339),
-			Error:     "invalid_ports",
-			Message:   err.Error(),
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_ports",
+			Message: err.Error(),
 		})
 		return
 	}
 
+	// Ports expected to be open are checked alongside the requested ones
+	var expectOpen []int
+	if v := query.Get("expect_open"); v != "" {
+		expectOpen, err = parsePorts(v, apiKey)
+		if err == nil {
+			if query.Get("ports") == "" {
+				ports = nil
+			}
+			ports = mergePorts(ports, expectOpen)
+			if len(ports) > maxPorts {
+				err = fmt.Errorf("too many ports (max %d)", maxPorts)
+			}
+		}
+		if err != nil {
+			rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+				Error:   "invalid_ports",
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+
+	// Ports expected to be closed: reaching one of them fails the check
+	var expectClosed []int
+	if v := query.Get("expect_closed"); v != "" {
+		expectClosed, err = parsePorts(v, apiKey)
+		if err == nil {
+			if query.Get("ports") == "" && expectOpen == nil {
+				ports = nil
+			}
+			ports = mergePorts(ports, expectClosed)
+			if len(ports) > maxPorts {
+				err = fmt.Errorf("too many ports (max %d)", maxPorts)
+			}
+			for _, port := range expectClosed {
+				if slices.Contains(expectOpen, port) {
+					err = fmt.Errorf("port %d cannot be expected both open and closed", port)
+					break
+				}
+			}
+		}
+		if err != nil {
+			rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+				Error:   "invalid_ports",
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+
 	challenge := query.Get("challenge")
 	challengePath := query.Get("challenge_path")
 	challengePortStr := query.Get("challenge_port")
-	tlsAnalyze := query.Get("tls_analyze") != "false"
-	wantBanner := query.Get("banner") == "true"
+	challengeHost := query.Get("challenge_host")
+	options, err := parseCheckOptions(query)
+	if err != nil {
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_opts",
+			Message: err.Error(),
+		})
+		return
+	}
+	httpPath := query.Get("http_path")
+
+	var streamNDJSON bool
+	switch query.Get("format") {
+	case "", "json":
+	case "ndjson":
+		streamNDJSON = true
+	default:
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_format",
+			Message: "format must be json or ndjson",
+		})
+		return
+	}
+
+	// results selects the map keyed by port, the ordered list, or both
+	resultsMode := query.Get("results")
+	switch resultsMode {
+	case "":
+		resultsMode = "map"
+	case "map", "list", "both":
+	default:
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_results",
+			Message: "results must be map, list or both",
+		})
+		return
+	}
+
+	tlsOpts := TLSProbeOptions{
+		MinVersion:         config.TLSMinVersion,
+		MaxVersion:         config.TLSMaxVersion,
+		Resumption:         options.TLSResumption,
+		ChainPEM:           options.ChainPEM,
+		MozillaTrust:       options.MozillaTrust,
+		ExpiryWarnDays:     config.ExpiryWarnDays,
+		ExpiryCriticalDays: config.ExpiryCriticalDays,
+		MinAcceptable:      config.MinAcceptableTLS,
+	}
+	for param, target := range map[string]*int{"expiry_warn_days": &tlsOpts.ExpiryWarnDays, "expiry_critical_days": &tlsOpts.ExpiryCriticalDays} {
+		if v := query.Get(param); v != "" {
+			days, err := strconv.Atoi(v)
+			if err != nil || days < 0 || days > maxExpiryDays {
+				rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+					Error:   "invalid_expiry_days",
+					Message: fmt.Sprintf("%s must be a number of days from 0 to %d", param, maxExpiryDays),
+				})
+				return
+			}
+			*target = days
+		}
+	}
+
+	// Hostnames are converted to punycode before use
+	for param, target := range map[string]*string{"sni": &tlsOpts.ServerName, "challenge_host": &challengeHost} {
+		if v := query.Get(param); v != "" {
+			ascii, err := asciiHostname(v)
+			if err != nil {
+				rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+					Error:   "invalid_hostname",
+					Message: fmt.Sprintf("%s: %v", param, err),
+				})
+				return
+			}
+			*target = ascii
+		}
+	}
+	for param, target := range map[string]*uint16{
+		"tls_min":            &tlsOpts.MinVersion,
+		"tls_max":            &tlsOpts.MaxVersion,
+		"min_acceptable_tls": &tlsOpts.MinAcceptable,
+	} {
+		if v := query.Get(param); v != "" {
+			version, err := parseTLSVersion(v)
+			if err != nil {
+				rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+					Error:   "invalid_tls_version",
+					Message: err.Error(),
+				})
+				return
+			}
+			*target = version
+		}
+	}
+	if tlsOpts.MinVersion != 0 && tlsOpts.MaxVersion != 0 && tlsOpts.MinVersion > tlsOpts.MaxVersion {
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_tls_version",
+			Message: "tls_min must not be greater than tls_max",
+		})
+		return
+	}
+
+	if httpPath != "" && (!strings.HasPrefix(httpPath, "/") || len(httpPath) > httpProbeMaxPath) {
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_http_path",
+			Message: fmt.Sprintf("http_path must start with / and be at most %d characters", httpProbeMaxPath),
+		})
+		return
+	}
+
+	// The challenge defaults to the scheme the client used to reach us
+	challengeScheme := query.Get("challenge_scheme")
+	if challengeScheme == "" {
+		challengeScheme = requestScheme(r)
+	}
+	if challengeScheme != "http" && challengeScheme != "https" {
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_challenge_scheme",
+			Message: "challenge_scheme must be http or https",
+		})
+		return
+	}
 
 	challengePort := 80
+	if challengeScheme == "https" {
+		challengePort = 443
+	}
 	if challengePortStr != "" {
 		if p, err := strconv.Atoi(challengePortStr); err == nil && p > 0 && p < 65536 {
 			challengePort = p
 		}
 	}
 
-	// Perform checks
-	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	keepaliveHold := defaultKeepaliveHold
+	if v := query.Get("keepalive_hold"); v != "" {
+		d, err := parseKeepaliveHold(v)
+		if err != nil {
+			rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+				Error:   "invalid_keepalive_hold",
+				Message: err.Error(),
+			})
+			return
+		}
+		keepaliveHold = d
+	}
+
+	challengeTimeout := config.Timeout
+	if v := query.Get("challenge_timeout"); v != "" {
+		d, err := parseChallengeTimeout(v)
+		if err != nil {
+			rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+				Error:   "invalid_challenge_timeout",
+				Message: err.Error(),
+			})
+			return
+		}
+		challengeTimeout = d
+	}
+
+	// Optional address of the other family for dual-stack checks. It is only
+	// accepted from authenticated callers and, unless the key is an admin
+	// key, must serve the challenge as well (checked before dialing).
+	var altIP, ipv4Addr, ipv6Addr string
+	if v := query.Get("alt_ip"); v != "" {
+		alt := net.ParseIP(v)
+		var problem string
+		switch {
+		case apiKey == nil:
+			problem = "alt_ip requires an API key"
+		case alt == nil:
+			problem = "alt_ip is not a valid IP address"
+		case isPrivateIP(alt):
+			problem = "alt_ip must be a public address"
+		case getIPVersion(alt) == getIPVersion(ip):
+			problem = "alt_ip must be of the other address family"
+		}
+		if problem != "" {
+			rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+				Error:   "invalid_alt_ip",
+				Message: problem,
+			})
+			return
+		}
+		altIP = alt.String()
+		ipv4Addr, ipv6Addr = clientIP, altIP
+		if getIPVersion(ip) == 6 {
+			ipv4Addr, ipv6Addr = altIP, clientIP
+		}
+	}
+
+	// A block of the caller's own network whose addresses are checked as
+	// well. Only the caller's address is proven, so this needs an API key.
+	var cidr netip.Prefix
+	if v := query.Get("cidr"); v != "" {
+		if apiKey == nil {
+			err = errors.New("cidr requires an API key")
+		} else {
+			cidr, err = parseCheckCIDR(v, clientIP)
+		}
+		if err != nil {
+			rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+				Error:   "invalid_cidr",
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+
+	challengeMatch := query.Get("challenge_match")
+	if challengeMatch != "" && challengeMatch != "exact" && challengeMatch != "contains" {
+		rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+			Error:   "invalid_challenge_match",
+			Message: "challenge_match must be exact or contains",
+		})
+		return
+	}
+
+	// Conditions that must all hold for the check to succeed
+	var require []string
+	if v := query.Get("require"); v != "" {
+		var problem string
+		for _, cond := range strings.Split(v, ",") {
+			cond = strings.TrimSpace(cond)
+			switch cond {
+			case "tcp":
+			case "tls_valid":
+				if !options.TLSAnalyze || !slices.Contains(ports, 443) {
+					problem = "tls_valid requires port 443 with TLS analysis"
+				}
+			case "challenge":
+				if challenge == "" {
+					problem = "challenge requires a challenge token"
+				}
+			case "http_2xx":
+				if httpPath == "" {
+					problem = "http_2xx requires http_path"
+				}
+			default:
+				problem = fmt.Sprintf("unknown condition %q", cond)
+			}
+			if problem != "" {
+				break
+			}
+			require = append(require, cond)
+		}
+		if problem != "" {
+			rejectCheck(w, r, start, clientIP, http.StatusBadRequest, CheckResponse{
+				Error:   "invalid_require",
+				Message: problem,
+			})
+			return
+		}
+	}
+
+	challengeOpts := ChallengeOptions{
+		Token:   challenge,
+		Path:    challengePath,
+		Port:    challengePort,
+		Scheme:  challengeScheme,
+		Timeout: challengeTimeout,
+		Host:    challengeHost,
+		Match:   challengeMatch,
+	}
+
+	// A challenge is only verified while checking its port. With
+	// challenge_add_port=true the port is added when the allowlist and the
+	// port limit permit; otherwise the response says it was not checked.
+	var notes []string
+	if challenge != "" && !slices.Contains(ports, challengePort) {
+		if options.ChallengeAddPort && portAllowed(apiKey, challengePort) && len(ports) < maxPorts {
+			ports = append(ports, challengePort)
+		} else {
+			notes = append(notes, "challenge_port_not_checked")
+		}
+	}
+	auditPortBypass(apiKey, clientIP, ports)
+
+	release := admit(w, r)
+	if release == nil {
+		rejectCheck(w, r, start, clientIP, http.StatusServiceUnavailable, CheckResponse{
+			Error:   "server_busy",
+			Message: "The server is at capacity. Please try again shortly.",
+		})
+		return
+	}
+	defer release()
+
+	// Sensitive ports are only dialed for clients that proved control of
+	// their IP by passing the challenge first. The same holds for alt_ip,
+	// which is dialed too; the other addresses of a cidr block cannot each
+	// serve the challenge, so cidr is refused.
+	var preverified *ChallengeRes
+	if requiresChallenge(ports) {
+		if challenge == "" {
+			rejectCheck(w, r, start, clientIP, http.StatusForbidden, CheckResponse{
+				Error:   "challenge_required",
+				Message: "These ports can only be checked together with a challenge",
+			})
+			return
+		}
+		if cidr.IsValid() {
+			rejectCheck(w, r, start, clientIP, http.StatusForbidden, CheckResponse{
+				Error:   "challenge_required",
+				Message: "cidr cannot be used with ports that require a challenge",
+			})
+			return
+		}
+		preverified = verifyChallenge(clientIP, challengeOpts)
+		if !preverified.Verified {
+			rejectCheck(w, r, start, clientIP, http.StatusForbidden, CheckResponse{
+				Error:   "challenge_required",
+				Message: "These ports can only be checked after the challenge verified (" + preverified.Error + ")",
+			})
+			return
+		}
+		if altIP != "" {
+			if res := verifyChallenge(altIP, challengeOpts); !res.Verified {
+				rejectCheck(w, r, start, clientIP, http.StatusForbidden, CheckResponse{
+					Error:   "challenge_required",
+					Message: "These ports can only be checked after the challenge verified on alt_ip too (" + res.Error + ")",
+				})
+				return
+			}
+		}
+	}
+
+	// Otherwise alt_ip would let any key holder probe arbitrary addresses
+	if altIP != "" && !apiKey.Admin && !requiresChallenge(ports) {
+		if challenge == "" {
+			rejectCheck(w, r, start, clientIP, http.StatusForbidden, CheckResponse{
+				Error:   "alt_ip_unverified",
+				Message: "alt_ip needs an admin API key or a challenge served on it",
+			})
+			return
+		}
+		if res := verifyChallenge(altIP, challengeOpts); !res.Verified {
+			rejectCheck(w, r, start, clientIP, http.StatusForbidden, CheckResponse{
+				Error:   "alt_ip_unverified",
+				Message: "The challenge did not verify on alt_ip (" + res.Error + ")",
+			})
+			return
+		}
+	}
+
+	// Perform checks. The execution may be shared with coalesced requests,
+	// so it must not end when this client disconnects; streams, which are
+	// never shared, still stop with their request.
+	parent := context.WithoutCancel(r.Context())
+	if streamNDJSON {
+		parent = r.Context()
+	}
+	ctx, cancel := context.WithTimeout(parent, checkDeadline(r))
 	defer cancel()
 
-	results := make(map[string]PortResult)
-	resultsBool := make(map[string]bool)
+	// checkOne probes a single port. It reports false if the port was
+	// skipped because the batch deadline had passed.
+	checkOne := func(port int) (PortResult, bool) {
+		// Skip the port once the batch deadline is spent
+		if ctx.Err() != nil {
+			return PortResult{Error: "check_deadline_exceeded"}, false
+		}
+
+		// Dual-stack clients race both families; follow-up probes use
+		// whichever address connected first
+		target := clientIP
+		var (
+			conn      net.Conn
+			latency   int64
+			err       error
+			dualStack *DualStackResult
+		)
+		if altIP != "" {
+			var winner string
+			conn, winner, latency, dualStack = dialDualStack(ctx, ipv4Addr, ipv6Addr, port)
+			if conn != nil {
+				target = winner
+			} else {
+				err = errors.New("no address family reachable")
+			}
+		} else {
+			conn, latency, err = dialPort(ctx, clientIP, port)
+		}
+		reachable := err == nil
 
-	for _, port := range ports {
-		portStr := strconv.Itoa(port)
-		reachable, latency, err := checkPort(ctx, clientIP, port)
-		
 		result := PortResult{
 			Reachable: reachable,
 			LatencyMs: latency,
+			DualStack: dualStack,
+		}
+		if options.Services {
+			result.Service = serviceNames[port]
 		}
 
 		if err != nil {
-			result.Error = "connection_failed"
+			if isResourceExhausted(err) {
+				result.Error = errorCode("server_resource_exhausted", err)
+				reportResourceExhausted(port, err)
+			} else {
+				result.Error = errorCode("connection_failed", err)
+			}
+		}
+
+		if reachable && options.LocalAddr {
+			result.LocalAddr = conn.LocalAddr().String()
+		}
+
+		if reachable && options.DetectReset {
+			result.ResetAfterConnect = resetAfterConnect(conn)
+		}
+
+		// Hold a second connection idle to catch paths that drop it
+		if reachable && options.Keepalive {
+			stable, held, reason := probeStable(ctx, target, port, keepaliveHold)
+			result.Stable = &stable
+			result.StableHeldMs = held.Milliseconds()
+			result.StableError = reason
 		}
 
-		// TLS analysis for port 443
-		if reachable && port == 443 && tlsAnalyze {
-			if tlsInfo, err := analyzeTLS(clientIP, port); err == nil {
+		// A web port may be served by something that is not HTTP
+		if reachable && options.DetectHTTP && httpScheme(port) == "http" {
+			isHTTP, sample := speaksHTTP(conn, target, port)
+			notHTTP := !isHTTP
+			result.NotHTTP = &notHTTP
+			result.NotHTTPSample = sample
+		}
+
+		// TLS analysis for port 443, upgrading the connection used for the
+		// reachability check instead of dialing again
+		if reachable && port == 443 && options.TLSAnalyze {
+			if tlsInfo, err := analyzeTLS(conn, tlsOpts); err == nil {
+				// The upgraded connection was dialed by the reachability check
+				tlsInfo.ConnectMs = latency
 				result.TLS = tlsInfo
+			} else {
+				result.TLSError = errorCode(classifyTLSError(err), err)
 			}
 		}
+		// Read last so the TLS exchange contributes RTT samples
+		if reachable && options.TCPInfo {
+			result.TCPInfo = tcpConnInfo(conn)
+		}
+		// An HTTP challenge on this port is sent over the same connection,
+		// unless detect_http or the TLS analysis already used it
+		connUsed := (options.DetectHTTP && httpScheme(port) == "http") || (port == 443 && options.TLSAnalyze)
+		if reachable && challenge != "" && port == challengeOpts.Port && preverified == nil &&
+			challengeOpts.Scheme == "http" && !connUsed {
+			result.Challenge = verifyChallengeOn(conn, target, challengeOpts)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+
+		if port == 443 && options.HTTPSCheck {
+			healthy, problems := httpsVerdict(result)
+			result.HTTPSHealthy = &healthy
+			result.HTTPSProblems = problems
+		}
 
 		// Challenge verification
-		if reachable && challenge != "" && port == challengePort {
-			result.Challenge = verifyChallenge(clientIP, port, challenge, challengePath)
+		if reachable && challenge != "" && port == challengeOpts.Port {
+			if preverified != nil {
+				result.Challenge = preverified
+			} else if result.Challenge == nil {
+				result.Challenge = verifyChallenge(target, challengeOpts)
+			}
+		}
+
+		// HTTP health check for web ports
+		if reachable && httpPath != "" && httpScheme(port) != "" {
+			if status, ttfb, err := probeHTTPPath(target, port, httpPath); err != nil {
+				result.HTTPError = "http_error"
+			} else {
+				result.HTTPStatus = status
+				result.TTFBMs = ttfb
+				result.HTTPHealthy = status >= 200 && status < 300
+			}
+		}
+
+		// Methods the web server advertises
+		if reachable && options.HTTPOptions && httpScheme(port) != "" {
+			if status, methods, err := probeHTTPOptions(target, port); err != nil {
+				result.HTTPError = "http_error"
+			} else {
+				result.OptionsStatus = status
+				result.AllowMethods = methods
+			}
+		}
+
+		// Plain HTTP should send visitors to HTTPS
+		if reachable && port == 80 && options.HTTPSRedirect {
+			if toHTTPS, location, err := probeHTTPSRedirect(target); err != nil {
+				result.HTTPError = "http_error"
+			} else {
+				result.RedirectsToHTTPS = &toHTTPS
+				result.RedirectTarget = location
+			}
+		}
+
+		// Mail servers should greet, answer EHLO and offer STARTTLS
+		if reachable && port == 25 && options.SMTPCheck {
+			result.SMTP = checkSMTP(target, tlsOpts)
+		}
+
+		if reachable && options.TFO {
+			attempted, accepted := probeTFO(target, port)
+			result.TFOAttempted = &attempted
+			result.TFOAccepted = &accepted
+		}
+
+		// Full-size segments lost on the way point to an MTU black hole
+		if reachable && options.LargePacket {
+			if ok, err := probeLargePacket(target, port); errors.Is(err, errLargePacketUnsupported) {
+				result.LargePacketError = "large_packet_unsupported"
+			} else if err != nil {
+				result.LargePacketError = "large_packet_failed"
+			} else {
+				result.LargePacketOK = &ok
+			}
 		}
 
 		// Banner grabbing
 		// Auto-grab for known service ports (SSH, FTP, SMTP, etc.) or if explicitly requested
-		shouldGrabBanner := wantBanner || port == 22 || port == 21 || port == 25
-		if reachable && shouldGrabBanner {
-			if banner := grabBanner(clientIP, port); banner != "" {
+		shouldGrabBanner := options.Banner || port == 22 || port == 21 || port == 25
+		if reachable && shouldGrabBanner && !bannerAllowed(ip) {
+			result.BannerError = "banner_disabled"
+		} else if reachable && shouldGrabBanner {
+			if banner := grabBanner(target, port); banner != "" {
 				result.Banner = banner
+				result.HTTPVersion = httpStatusVersion(banner)
+				if proto, software, comment, ok := parseSSHBanner(banner); ok {
+					result.SSHProtocol = proto
+					result.SSHSoftware = software
+					result.SSHComment = comment
+				}
 			}
 		}
 
-		results[portStr] = result
-		resultsBool[portStr] = reachable
+		return result, true
+	}
+
+	// format=ndjson streams each port as it completes, then the summary
+	var stream *json.Encoder
+	if streamNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		stream = json.NewEncoder(w)
+	}
+
+	// runChecks probes all ports concurrently, optionally paced by a
+	// per-request limit on simultaneous dials
+	runChecks := func() checkOutcome {
+		results := make(map[string]PortResult)
+		resultsBool := make(map[string]bool)
+
+		var (
+			resultsMu                  sync.Mutex
+			wg                         sync.WaitGroup
+			portsChecked, portsSkipped int
+		)
+
+		var dialSlots chan struct{}
+		if config.MaxDialsPerCheck > 0 {
+			dialSlots = make(chan struct{}, config.MaxDialsPerCheck)
+		}
+		for _, port := range ports {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if dialSlots != nil {
+					dialSlots <- struct{}{}
+					defer func() { <-dialSlots }()
+				}
+
+				result, checked := checkOne(port)
+
+				resultsMu.Lock()
+				defer resultsMu.Unlock()
+				portStr := strconv.Itoa(port)
+				results[portStr] = result
+				resultsBool[portStr] = result.Reachable
+				if checked {
+					portsChecked++
+				} else {
+					portsSkipped++
+				}
+				if stream != nil {
+					encodeResponse(stream, PortResultEntry{Port: port, PortResult: redactResult(result)})
+					if flusher, ok := w.(http.Flusher); ok {
+						flusher.Flush()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		return checkOutcome{results, resultsBool, portsChecked, portsSkipped}
+	}
+
+	// Streams cannot be shared; other checks are coalesced with identical
+	// ones already in flight
+	var outcome checkOutcome
+	if stream != nil {
+		outcome = runChecks()
+	} else {
+		v, _, _ := checkGroup.Do(coalesceKey(clientIP, challengeScheme, apiKey, ports, r), func() (interface{}, error) {
+			return runChecks(), nil
+		})
+		outcome = v.(checkOutcome)
 	}
+	results, resultsBool := outcome.results, outcome.resultsBool
+	portsChecked, portsSkipped := outcome.portsChecked, outcome.portsSkipped
 
 	// Increment check counter
 	checkMu.Lock()
@@ -734,16 +2873,100 @@ func handleCheck(w http.ResponseWriter, r *http.Request) {
 		Success:   true,
 		ClientIP:  clientIP,
 		IPVersion: getIPVersion(ip),
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Timestamp: formatTimestamp(time.Now()),
 		Results:   results,
+		Notes:     notes,
+		Warnings:  warnings,
+	}
+
+	response.PortGroups = portGroupsIn(query.Get("ports") + "," + query.Get("expect_open") + "," + query.Get("expect_closed"))
+
+	if options.PTR {
+		response.PTR = lookupPTRCached(r.Context(), clientIP)
+	}
+	if options.Traceroute {
+		response.Traceroute = traceroute(r.Context(), ip)
+	}
+	if cidr.IsValid() {
+		response.CIDR = cidr.String()
+		response.CIDRResults = checkCIDR(ctx, cidr, ports)
+	}
+
+	if len(require) > 0 {
+		response.FailedConditions = failedConditions(require, results)
+		if len(response.FailedConditions) > 0 {
+			response.Success = false
+			response.Error = "requirements_not_met"
+		}
+	}
+
+	if expectOpen != nil {
+		allOpen := true
+		for _, port := range expectOpen {
+			if !resultsBool[strconv.Itoa(port)] {
+				allOpen = false
+				response.ExpectedUnreachable = append(response.ExpectedUnreachable, port)
+			}
+		}
+		response.AllExpectedOpen = &allOpen
+	}
+
+	if expectClosed != nil {
+		allClosed := true
+		for _, port := range expectClosed {
+			result := results[strconv.Itoa(port)]
+			// A port the deadline kept from being dialed is not known closed
+			if result.Reachable || result.Error == "check_deadline_exceeded" {
+				allClosed = false
+				response.ExpectedReachable = append(response.ExpectedReachable, port)
+			}
+		}
+		response.AllExpectedClosed = &allClosed
+		if !allClosed {
+			response.Success = false
+			if response.Error == "" {
+				response.Error = "expected_closed_reachable"
+			}
+		}
+	}
+
+	if stream != nil {
+		// The ports were already streamed; the summary carries the rest
+		summary := response
+		summary.Results = nil
+		redactResponse(&summary)
+		summary.SchemaVersion = schemaVersion
+		encodeResponse(stream, summary)
+	} else {
+		w.Header().Set("X-Check-Duration-Ms", strconv.FormatInt(time.Since(start).Milliseconds(), 10))
+		w.Header().Set("X-Ports-Checked", strconv.Itoa(portsChecked))
+		w.Header().Set("X-Ports-Skipped", strconv.Itoa(portsSkipped))
+		if resultsMode != "map" {
+			response.ResultsList = resultsList(ports, results)
+		}
+		if resultsMode == "list" {
+			response.Results = nil
+		}
+		writeCheckResponse(w, r, http.StatusOK, response)
+	}
+
+	// The caller opted out of being recorded; the check counter above
+	// still includes it
+	if doNotLog(r) {
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	if history != nil {
+		history.Add(trustedClientIP(r), HistoryEntry{
+			Timestamp: response.Timestamp,
+			Ports:     ports,
+			Results:   resultsBool,
+		})
+	}
 
 	// Log access
 	logger.LogAccess(AccessLogEntry{
-		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Timestamp:  formatTimestamp(time.Now()),
 		IP:         clientIP,
 		Method:     r.Method,
 		Path:       r.URL.Path,
@@ -751,68 +2974,160 @@ func handleCheck(w http.ResponseWriter, r *http.Request) {
 		Results:    resultsBool,
 		DurationMs: time.Since(start).Milliseconds(),
 		Status:     http.StatusOK,
+		Scheme:     requestScheme(r),
+		Query:      loggedQuery(r),
+		// A client that proved control of its IP may be logged in full
+		ChallengeVerified: challengeVerified(results),
 	})
 }
 
-func handleSimple(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
-
-	// Rate limiting
-	if !rateLimiter.GetLimiter(clientIP).Allow() {
-		w.WriteHeader(http.StatusTooManyRequests)
-		fmt.Fprint(w, "error")
-		return
+// challengeVerified reports whether any port's challenge succeeded
+func challengeVerified(results map[string]PortResult) bool {
+	for _, result := range results {
+		if result.Challenge != nil && result.Challenge.Verified {
+			return true
+		}
 	}
+	return false
+}
 
-	ip := net.ParseIP(clientIP)
-	if ip == nil || isPrivateIP(ip) {
-		w.WriteHeader(http.StatusForbidden)
+func handleSimple(w http.ResponseWriter, r *http.Request) {
+	_, reachable, status := runSimpleCheck(w, r, simpleCache)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
 		fmt.Fprint(w, "error")
 		return
 	}
+	fmt.Fprint(w, yesNo(reachable))
+}
+
+// runSimpleCheck carries out a single-port check for /simple and /badge and
+// returns the port, whether it was reachable and the HTTP status to answer
+// with. Answers are served from and stored in cache when it is not nil.
+func runSimpleCheck(w http.ResponseWriter, r *http.Request, cache *TTLCache[bool]) (port int, reachable bool, status int) {
+	clientIP := getClientIP(r)
 
 	portStr := r.URL.Query().Get("port")
-	port := 80
+	port = 80
 	if portStr != "" {
 		if p, err := strconv.Atoi(portStr); err == nil {
 			port = p
 		}
 	}
 
-	if !config.AllowedPorts[port] {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "error")
-		return
+	if maintenance.Load() {
+		setRetryAfter(w)
+		return port, false, http.StatusServiceUnavailable
 	}
 
+	// Rate limiting
+	if !rateLimitExempt(r) && !rateLimiter.GetLimiter(clientIP).Allow() {
+		return port, false, http.StatusTooManyRequests
+	}
+
+	apiKey, err := authenticate(r)
+	if err != nil {
+		return port, false, http.StatusUnauthorized
+	}
+	if !checkQuota(w, apiKey) {
+		return port, false, http.StatusTooManyRequests
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil || isPrivateIP(ip) {
+		return port, false, http.StatusForbidden
+	}
+
+	if !portAllowed(apiKey, port) {
+		return port, false, http.StatusBadRequest
+	}
+	// There is no challenge here, so these ports are only available via /check
+	if config.ChallengeRequiredPorts[port] {
+		return port, false, http.StatusForbidden
+	}
+	auditPortBypass(apiKey, clientIP, []int{port})
+
+	// Tight polling loops get the cached answer for the TTL window
+	cacheKey := clientIP + "|" + strconv.Itoa(port)
+	if cache != nil {
+		if reachable, ok := cache.Get(cacheKey); ok {
+			w.Header().Set("X-Cache", "hit")
+			return port, reachable, http.StatusOK
+		}
+		w.Header().Set("X-Cache", "miss")
+	}
+
+	release := admit(w, r)
+	if release == nil {
+		return port, false, http.StatusServiceUnavailable
+	}
+	defer release()
+
 	ctx, cancel := context.WithTimeout(r.Context(), config.Timeout)
 	defer cancel()
 
-	reachable, _, _ := checkPort(ctx, clientIP, port)
-	
-	if reachable {
-		fmt.Fprint(w, "yes")
-	} else {
-		fmt.Fprint(w, "no")
+	reachable, _, err = checkPort(ctx, clientIP, port)
+	if err != nil && isResourceExhausted(err) {
+		reportResourceExhausted(port, err)
+		return port, false, http.StatusServiceUnavailable
+	}
+	if cache != nil {
+		cache.Set(cacheKey, reachable)
+	}
+	return port, reachable, http.StatusOK
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
 	}
+	return "no"
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	
+
 	checkMu.Lock()
 	count := checkCount
 	checkMu.Unlock()
 
+	// Collect degraded components
+	var problems []string
+	if !logger.Healthy() {
+		problems = append(problems, "log_write_failing")
+	}
+	if last := lastResourceExhausted.Load(); last != 0 && time.Since(time.Unix(last, 0)) < resourceExhaustedWindow {
+		problems = append(problems, "resource_exhausted")
+	}
+
+	status := "healthy"
+	statusCode := http.StatusOK
+	if len(problems) > 0 {
+		status = "degraded"
+		statusCode = http.StatusServiceUnavailable
+	}
+	if maintenance.Load() {
+		status = "maintenance"
+		statusCode = http.StatusServiceUnavailable
+		setRetryAfter(w)
+	}
+
 	response := HealthResponse{
-		Status:         "healthy",
+		Status:         status,
 		UptimeSeconds:  int64(time.Since(startTime).Seconds()),
 		Version:        "1.0.0",
 		ChecksLastHour: count, // Simplified - would need proper hourly tracking
 		Goroutines:     0,     // Could use runtime.NumGoroutine()
+		Problems:       problems,
+		ActiveChecks:   activeChecks.Load(),
+		SchemaVersion:  schemaVersion,
+	}
+	if admission != nil {
+		response.QueuedChecks = admission.queued.Load()
 	}
 
-	json.NewEncoder(w).Encode(response)
+	w.WriteHeader(statusCode)
+	encodeResponse(json.NewEncoder(w), response)
 }
 
 func main() {
@@ -833,6 +3148,72 @@ func main() {
 			config.RateLimitPerMin = r
 		}
 	}
+	if rateLimit := os.Getenv("REFLECTOR_RATE_LIMIT_PER_MIN_IPV6"); rateLimit != "" {
+		r, err := strconv.Atoi(rateLimit)
+		if err != nil || r < 1 {
+			log.Fatalf("Invalid REFLECTOR_RATE_LIMIT_PER_MIN_IPV6: %q", rateLimit)
+		}
+		config.RateLimitPerMinIPv6 = r
+	}
+	if prefixLen := os.Getenv("REFLECTOR_RATE_LIMIT_IPV6_PREFIX"); prefixLen != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(prefixLen, "/"))
+		if err != nil || n < 1 || n > 128 {
+			log.Fatalf("Invalid REFLECTOR_RATE_LIMIT_IPV6_PREFIX: %q (must be 1-128)", prefixLen)
+		}
+		config.RateLimitIPv6Prefix = n
+	}
+	if algorithm := os.Getenv("REFLECTOR_RATE_LIMIT_ALGORITHM"); algorithm != "" {
+		parsed, err := parseRateLimitAlgorithm(algorithm)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_RATE_LIMIT_ALGORITHM: %v", err)
+		}
+		config.RateLimitAlgorithm = parsed
+	}
+	if format := os.Getenv("REFLECTOR_TIMESTAMP_FORMAT"); format != "" {
+		parsed, err := parseTimestampFormat(format)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_TIMESTAMP_FORMAT: %v", err)
+		}
+		config.TimestampFormat = parsed
+	}
+	if zone := os.Getenv("REFLECTOR_TIMESTAMP_TIMEZONE"); zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_TIMESTAMP_TIMEZONE: %v", err)
+		}
+		config.TimestampLocation = loc
+	}
+	if fieldCase := os.Getenv("REFLECTOR_JSON_FIELD_CASE"); fieldCase != "" {
+		switch fieldCase {
+		case "snake":
+			config.CamelCaseJSON = false
+		case "camel":
+			config.CamelCaseJSON = true
+		default:
+			log.Fatalf("Invalid REFLECTOR_JSON_FIELD_CASE: %q (want snake or camel)", fieldCase)
+		}
+	}
+	if v := os.Getenv("REFLECTOR_TLS_MIN_VERSION"); v != "" {
+		version, err := parseTLSVersion(v)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_TLS_MIN_VERSION: %v", err)
+		}
+		config.TLSMinVersion = version
+	}
+	if v := os.Getenv("REFLECTOR_TLS_MAX_VERSION"); v != "" {
+		version, err := parseTLSVersion(v)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_TLS_MAX_VERSION: %v", err)
+		}
+		config.TLSMaxVersion = version
+	}
+	if v := os.Getenv("REFLECTOR_MIN_ACCEPTABLE_TLS"); v != "" {
+		version, err := parseTLSVersion(v)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_MIN_ACCEPTABLE_TLS: %v", err)
+		}
+		config.MinAcceptableTLS = version
+	}
 	if allowedPorts := os.Getenv("REFLECTOR_ALLOWED_PORTS"); allowedPorts != "" {
 		config.AllowedPorts = make(map[int]bool)
 		for _, p := range strings.Split(allowedPorts, ",") {
@@ -842,8 +3223,270 @@ func main() {
 		}
 	}
 
-	// Initialize logger
+	if ports := os.Getenv("REFLECTOR_CHALLENGE_REQUIRED_PORTS"); ports != "" {
+		config.ChallengeRequiredPorts = make(map[int]bool)
+		for _, p := range strings.Split(ports, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || port < 1 || port > 65535 {
+				log.Fatalf("Invalid REFLECTOR_CHALLENGE_REQUIRED_PORTS entry: %q", p)
+			}
+			config.ChallengeRequiredPorts[port] = true
+		}
+	}
+
+	if redact := os.Getenv("REFLECTOR_REDACT_FIELDS"); redact != "" {
+		config.RedactFields = make(map[string]bool)
+		for _, field := range strings.Split(redact, ",") {
+			field = strings.TrimSpace(field)
+			if !redactableFields[field] {
+				log.Fatalf("Invalid REFLECTOR_REDACT_FIELDS entry: %q", field)
+			}
+			config.RedactFields[field] = true
+		}
+	}
+	if keysFile := os.Getenv("REFLECTOR_API_KEYS_FILE"); keysFile != "" {
+		config.APIKeysFile = keysFile
+	}
+	if delay := os.Getenv("REFLECTOR_HAPPY_EYEBALLS_DELAY"); delay != "" {
+		if d, err := time.ParseDuration(delay); err == nil && d >= 0 {
+			config.HappyEyeballsDelay = d
+		}
+	}
+	if size := os.Getenv("REFLECTOR_HISTORY_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil && n >= 0 {
+			config.HistorySize = n
+		}
+	}
+	if ttl := os.Getenv("REFLECTOR_ENRICHMENT_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid REFLECTOR_ENRICHMENT_CACHE_TTL: %q", ttl)
+		}
+		config.EnrichmentCacheTTL = d
+	}
+	if size := os.Getenv("REFLECTOR_ENRICHMENT_CACHE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid REFLECTOR_ENRICHMENT_CACHE_SIZE: %q (must be a positive number)", size)
+		}
+		config.EnrichmentCacheSize = n
+	}
+	if maxIPs := os.Getenv("REFLECTOR_HISTORY_MAX_IPS"); maxIPs != "" {
+		if n, err := strconv.Atoi(maxIPs); err == nil && n > 0 {
+			config.HistoryMaxIPs = n
+		}
+	}
+	for env, target := range map[string]*time.Duration{
+		"REFLECTOR_READ_TIMEOUT":           &config.ReadTimeout,
+		"REFLECTOR_WRITE_TIMEOUT":          &config.WriteTimeout,
+		"REFLECTOR_IDLE_TIMEOUT":           &config.IdleTimeout,
+		"REFLECTOR_MAX_CHECK_DURATION":     &config.MaxCheckDuration,
+		"REFLECTOR_PEER_TIMEOUT":           &config.PeerTimeout,
+		"REFLECTOR_BANNER_CONNECT_TIMEOUT": &config.BannerConnectTimeout,
+		"REFLECTOR_BANNER_READ_TIMEOUT":    &config.BannerReadTimeout,
+	} {
+		if v := os.Getenv(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				log.Fatalf("Invalid %s: %q (must be a positive duration)", env, v)
+			}
+			*target = d
+		}
+	}
+	if ttl := os.Getenv("REFLECTOR_SIMPLE_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid REFLECTOR_SIMPLE_CACHE_TTL: %q", ttl)
+		}
+		config.SimpleCacheTTL = d
+	}
+	if ttl := os.Getenv("REFLECTOR_BADGE_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid REFLECTOR_BADGE_CACHE_TTL: %q", ttl)
+		}
+		config.BadgeCacheTTL = d
+	}
+	if workers := os.Getenv("REFLECTOR_MAX_CONCURRENT_CHECKS"); workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid REFLECTOR_MAX_CONCURRENT_CHECKS: %q", workers)
+		}
+		config.MaxConcurrentChecks = n
+	}
+	if queueSize := os.Getenv("REFLECTOR_CHECK_QUEUE_SIZE"); queueSize != "" {
+		n, err := strconv.Atoi(queueSize)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid REFLECTOR_CHECK_QUEUE_SIZE: %q", queueSize)
+		}
+		config.CheckQueueSize = n
+	}
+	if dials := os.Getenv("REFLECTOR_MAX_DIALS_PER_CHECK"); dials != "" {
+		n, err := strconv.Atoi(dials)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid REFLECTOR_MAX_DIALS_PER_CHECK: %q", dials)
+		}
+		config.MaxDialsPerCheck = n
+	}
+	if maxConns := os.Getenv("REFLECTOR_MAX_CONNECTIONS"); maxConns != "" {
+		n, err := strconv.Atoi(maxConns)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid REFLECTOR_MAX_CONNECTIONS: %q", maxConns)
+		}
+		config.MaxConnections = n
+	}
+	config.LogVerifiedIPs = os.Getenv("REFLECTOR_LOG_VERIFIED_IPS") == "true"
+	config.LogQuery = os.Getenv("REFLECTOR_LOG_QUERY") == "true"
+	config.DoNotLogRequireKey = os.Getenv("REFLECTOR_DO_NOT_LOG_REQUIRE_KEY") == "true"
+	config.SelfTest = os.Getenv("REFLECTOR_SELF_TEST") == "true"
+	if target := os.Getenv("REFLECTOR_SELF_TEST_TARGET"); target != "" {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			log.Fatalf("Invalid REFLECTOR_SELF_TEST_TARGET: %q (want host:port)", target)
+		}
+		config.SelfTestTarget = target
+	}
+	config.DebugEchoRequireKey = os.Getenv("REFLECTOR_DEBUG_ECHO_REQUIRE_KEY") == "true"
+	config.Debug = os.Getenv("REFLECTOR_DEBUG") == "true"
+	if config.Debug {
+		log.Printf("Warning: REFLECTOR_DEBUG is on, error codes include raw error messages")
+	}
+	if msg := os.Getenv("REFLECTOR_MAINTENANCE_MESSAGE"); msg != "" {
+		config.MaintenanceMessage = msg
+	}
+	if msg := os.Getenv("REFLECTOR_NOT_FOUND_MESSAGE"); msg != "" {
+		config.NotFoundMessage = msg
+	}
+	if retry := os.Getenv("REFLECTOR_MAINTENANCE_RETRY_AFTER"); retry != "" {
+		if d, err := time.ParseDuration(retry); err == nil && d > 0 {
+			config.MaintenanceRetryAfter = d
+		}
+	}
+	maintenance.Store(os.Getenv("REFLECTOR_MAINTENANCE") == "true")
+	if blocked := os.Getenv("REFLECTOR_BLOCKED_CIDRS"); blocked != "" {
+		if err := addBlockedCIDRs(blocked); err != nil {
+			log.Fatalf("Invalid REFLECTOR_BLOCKED_CIDRS: %v", err)
+		}
+	}
+	if maxBytes := os.Getenv("REFLECTOR_CHALLENGE_MAX_BYTES"); maxBytes != "" {
+		n, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid REFLECTOR_CHALLENGE_MAX_BYTES: %q", maxBytes)
+		}
+		config.ChallengeMaxBytes = n
+	}
+	if redirects := os.Getenv("REFLECTOR_CHALLENGE_MAX_REDIRECTS"); redirects != "" {
+		n, err := strconv.Atoi(redirects)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid REFLECTOR_CHALLENGE_MAX_REDIRECTS: %q", redirects)
+		}
+		config.ChallengeMaxRedirects = n
+	}
+	for env, target := range map[string]*int{
+		"REFLECTOR_EXPIRY_WARN_DAYS":     &config.ExpiryWarnDays,
+		"REFLECTOR_EXPIRY_CRITICAL_DAYS": &config.ExpiryCriticalDays,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > maxExpiryDays {
+				log.Fatalf("Invalid %s: %q (must be 0 to %d days)", env, v, maxExpiryDays)
+			}
+			*target = n
+		}
+	}
+	for env, target := range map[string]*[]*net.IPNet{
+		"REFLECTOR_BANNER_ALLOW_CIDRS":      &config.BannerAllowCIDRs,
+		"REFLECTOR_BANNER_DENY_CIDRS":       &config.BannerDenyCIDRs,
+		"REFLECTOR_CHALLENGE_ALLOWED_CIDRS": &config.ChallengeAllowedCIDRs,
+		"REFLECTOR_RATE_LIMIT_EXEMPT_CIDRS": &config.RateLimitExemptCIDRs,
+	} {
+		if v := os.Getenv(env); v != "" {
+			blocks, err := parseCIDRs(v)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", env, err)
+			}
+			*target = blocks
+		}
+	}
+	if hosts := os.Getenv("REFLECTOR_CHALLENGE_ALLOWED_HOSTS"); hosts != "" {
+		for _, host := range strings.Split(hosts, ",") {
+			host = strings.TrimSpace(host)
+			if host == "" {
+				continue
+			}
+			name, wildcard := strings.CutPrefix(host, "*.")
+			ascii, err := asciiHostname(name)
+			if err != nil {
+				log.Fatalf("Invalid REFLECTOR_CHALLENGE_ALLOWED_HOSTS: %v", err)
+			}
+			if wildcard {
+				ascii = "*." + ascii
+			}
+			config.ChallengeAllowedHosts = append(config.ChallengeAllowedHosts, strings.ToLower(ascii))
+		}
+	}
+	if redact := os.Getenv("REFLECTOR_BANNER_REDACT"); redact != "" {
+		parsed, err := parseBannerRedact(redact)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_BANNER_REDACT: %v", err)
+		}
+		config.BannerRedact = parsed
+	}
+	if probes := os.Getenv("REFLECTOR_BANNER_PROBES"); probes != "" {
+		parsed, err := parseBannerProbes(probes)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_BANNER_PROBES: %v", err)
+		}
+		config.BannerProbes = parsed
+	}
+	if dnsResolver := os.Getenv("REFLECTOR_DNS_RESOLVER"); dnsResolver != "" {
+		config.DNSResolver = dnsResolver
+		resolver = newResolver(dnsResolver)
+	}
+	// Built after the resolver, which looks up the proxy's name
+	if upstream := os.Getenv("REFLECTOR_UPSTREAM_PROXY"); upstream != "" {
+		u, err := url.Parse(upstream)
+		if err == nil {
+			upstreamProxy, err = newUpstreamDialer(u, &net.Dialer{Resolver: resolver})
+		}
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_UPSTREAM_PROXY: %v", err)
+		}
+		config.UpstreamProxy = u
+	}
+	if userAgent := os.Getenv("REFLECTOR_USER_AGENT"); userAgent != "" {
+		config.UserAgent = userAgent
+	}
+	if name := os.Getenv("REFLECTOR_SMTP_HELO_NAME"); name != "" {
+		config.SMTPHelloName = name
+	}
+	if groups := os.Getenv("REFLECTOR_PORT_GROUPS"); groups != "" {
+		parsed, err := parsePortGroups(groups)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_PORT_GROUPS: %v", err)
+		}
+		config.PortGroups = parsed
+	}
+	if peers := os.Getenv("REFLECTOR_PEERS"); peers != "" {
+		parsed, err := parsePeers(peers)
+		if err != nil {
+			log.Fatalf("Invalid REFLECTOR_PEERS: %v", err)
+		}
+		config.Peers = parsed
+	}
+	if tlsPort := os.Getenv("REFLECTOR_TLS_PORT"); tlsPort != "" {
+		config.TLSPort = tlsPort
+	}
+	config.TLSCertFile = os.Getenv("REFLECTOR_TLS_CERT")
+	config.TLSKeyFile = os.Getenv("REFLECTOR_TLS_KEY")
+
+	// Load API keys
 	var err error
+	apiKeys, err = LoadAPIKeys(config.APIKeysFile)
+	if err != nil {
+		log.Fatalf("Could not load API keys: %v", err)
+	}
+
+	// Initialize logger
 	logger, err = NewLogger(config.LogDir)
 	if err != nil {
 		log.Printf("Warning: Could not initialize file logger: %v", err)
@@ -855,8 +3498,45 @@ func main() {
 	}
 	defer logger.Close()
 
+	if config.SelfTest {
+		selfTestOrExit()
+	}
+
 	// Initialize rate limiter
 	rateLimiter = NewIPRateLimiter()
+	if config.HistorySize > 0 {
+		history = NewHistoryStore(config.HistorySize, config.HistoryMaxIPs)
+	}
+	if config.MaxConcurrentChecks > 0 {
+		admission = NewAdmissionQueue(config.MaxConcurrentChecks, config.CheckQueueSize)
+	}
+	if config.SimpleCacheTTL > 0 {
+		simpleCache = NewTTLCache[bool](config.SimpleCacheTTL, 0)
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			for range ticker.C {
+				simpleCache.Cleanup()
+			}
+		}()
+	}
+	if config.BadgeCacheTTL > 0 {
+		badgeCache = NewTTLCache[bool](config.BadgeCacheTTL, 0)
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			for range ticker.C {
+				badgeCache.Cleanup()
+			}
+		}()
+	}
+	if config.EnrichmentCacheTTL > 0 {
+		enrichmentCache = NewTTLCache[any](config.EnrichmentCacheTTL, config.EnrichmentCacheSize)
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			for range ticker.C {
+				enrichmentCache.Cleanup()
+			}
+		}()
+	}
 	startTime = time.Now()
 
 	// Cleanup rate limiter periodically
@@ -870,40 +3550,121 @@ func main() {
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/check", handleCheck)
+	mux.HandleFunc("/check/multi", handleCheckMulti)
 	mux.HandleFunc("/simple", handleSimple)
+	mux.HandleFunc("/badge", handleBadge)
 	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/fingerprint", handleFingerprint)
+	mux.HandleFunc("/history", handleHistory)
+	mux.HandleFunc("/admin/maintenance", handleAdminMaintenance)
+	mux.HandleFunc("/debug/echo", handleDebugEcho)
+	mux.HandleFunc("/", handleNotFound)
 
 	// Create server
 	server := &http.Server{
 		Addr:         ":" + config.Port,
 		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+
+	// Optional TLS listener, needed for ClientHello fingerprinting
+	var tlsServer *http.Server
+	if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+		fingerprints = NewFingerprintStore()
+		tlsServer = &http.Server{
+			Addr:         ":" + config.TLSPort,
+			Handler:      mux,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			IdleTimeout:  config.IdleTimeout,
+			TLSConfig: &tls.Config{
+				GetConfigForClient: fingerprints.GetConfigForClient,
+			},
+			ConnState: fingerprints.ConnState,
+		}
 	}
 
+	// Toggle maintenance mode with SIGUSR1
+	watchMaintenanceSignal()
+
 	// Graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	shutdownDone := make(chan error, 1)
 	go func() {
 		<-sigChan
 		log.Println("Shutting down gracefully...")
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
 		defer cancel()
 
-		server.Shutdown(ctx)
+		var err error
+		if tlsServer != nil {
+			err = tlsServer.Shutdown(ctx)
+		}
+		shutdownDone <- errors.Join(err, server.Shutdown(ctx))
 	}()
 
 	// Start server
 	log.Printf("Reflector server starting on port %s", config.Port)
 	log.Printf("Allowed ports: %v", config.AllowedPorts)
-	log.Printf("Rate limit: %d requests/min per IP", config.RateLimitPerMin)
+	ipv6Limit := config.RateLimitPerMin
+	if config.RateLimitPerMinIPv6 > 0 {
+		ipv6Limit = config.RateLimitPerMinIPv6
+	}
+	log.Printf("Rate limit: %d requests/min per IPv4 address, %d per IPv6 /%d", config.RateLimitPerMin, ipv6Limit, config.RateLimitIPv6Prefix)
+	if apiKeys.Len() > 0 {
+		log.Printf("API keys loaded: %d", apiKeys.Len())
+	}
+	if len(config.Peers) > 0 {
+		log.Printf("Peer reflectors for /check/multi: %d", len(config.Peers))
+	}
+
+	if config.MaxConnections > 0 {
+		log.Printf("Connection limit: %d per listener", config.MaxConnections)
+	}
+
+	if tlsServer != nil {
+		log.Printf("TLS listener starting on port %s", config.TLSPort)
+		tlsListener, err := listen(tlsServer.Addr)
+		if err != nil {
+			log.Fatalf("TLS server error: %v", err)
+		}
+		go func() {
+			if err := tlsServer.ServeTLS(tlsListener, config.TLSCertFile, config.TLSKeyFile); err != http.ErrServerClosed {
+				log.Fatalf("TLS server error: %v", err)
+			}
+		}()
+	}
 
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	listener, err := listen(server.Addr)
+	if err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+	if err := server.Serve(listener); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
 
+	// Wait for in-flight requests, then record how the process ended
+	shutdownErr := <-shutdownDone
+	checkMu.Lock()
+	served := checkCount
+	checkMu.Unlock()
+	fields := map[string]interface{}{
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+		"checks_served":  served,
+		"clean":          shutdownErr == nil,
+	}
+	if shutdownErr != nil {
+		fields["error"] = shutdownErr.Error()
+		logger.LogError("error", "server stopped", fields)
+		log.Printf("Server stopped uncleanly: %v", shutdownErr)
+		logger.Close()
+		os.Exit(1)
+	}
+	logger.LogError("info", "server stopped", fields)
 	log.Println("Server stopped")
 }
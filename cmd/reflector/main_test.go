@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setupTest restores the global configuration and state after the test
+func setupTest(t *testing.T) {
+	t.Helper()
+	saved := config
+	rateLimiter = NewIPRateLimiter()
+	t.Cleanup(func() { config = saved })
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// captureAccessLog replaces the logger with one whose access log is returned
+func captureAccessLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var access bytes.Buffer
+	saved := logger
+	logger = &Logger{accessLog: nopWriteCloser{&access}, errorLog: nopWriteCloser{io.Discard}}
+	t.Cleanup(func() { logger = saved })
+	return &access
+}
+
+func mustParseCIDRs(t *testing.T, s string) []*net.IPNet {
+	t.Helper()
+	blocks, err := parseCIDRs(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+func TestRateLimitExemptRequiresTrustedProxy(t *testing.T) {
+	setupTest(t)
+	config.RateLimitPerMin = 1
+	config.RateLimitExemptCIDRs = mustParseCIDRs(t, "1.1.1.0/24")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		wantLimit  bool
+	}{
+		{"spoofed header from untrusted peer", "203.0.113.5:40000", "1.1.1.1", true},
+		{"header from trusted proxy", "10.0.0.1:40000", "1.1.1.2", false},
+		{"exempt peer without proxy", "1.1.1.3:40000", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limited := false
+			for i := 0; i < 3; i++ {
+				// The port is invalid, so requests stop right after the rate limit
+				r := httptest.NewRequest(http.MethodGet, "/simple?port=99999", nil)
+				r.RemoteAddr = tt.remoteAddr
+				if tt.xff != "" {
+					r.Header.Set("X-Forwarded-For", tt.xff)
+				}
+				w := httptest.NewRecorder()
+				handleSimple(w, r)
+				if w.Code == http.StatusTooManyRequests {
+					limited = true
+				}
+			}
+			if limited != tt.wantLimit {
+				t.Errorf("rate limited = %v, want %v", limited, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestCheckLogsOncePerRequest(t *testing.T) {
+	setupTest(t)
+	config.RateLimitPerMin = 1
+	config.Timeout = 200 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		query      string
+		exhaust    bool // use up the rate limit first
+		wantStatus int
+	}{
+		{"invalid ports", "192.0.2.10:40000", "ports=abc", false, http.StatusBadRequest},
+		{"private client", "127.0.0.1:40000", "ports=80", false, http.StatusForbidden},
+		{"rate limited", "192.0.2.11:40000", "ports=80", true, http.StatusTooManyRequests},
+		{"checked", "192.0.2.12:40000", "ports=80&tls_analyze=false", false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := captureAccessLog(t)
+			r := httptest.NewRequest(http.MethodGet, "/check?"+tt.query, nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.exhaust {
+				rateLimiter.GetLimiter(getClientIP(r)).Allow()
+			}
+			w := httptest.NewRecorder()
+			handleCheck(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			var entries []AccessLogEntry
+			dec := json.NewDecoder(access)
+			for dec.More() {
+				var entry AccessLogEntry
+				if err := dec.Decode(&entry); err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, entry)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("got %d access log entries, want 1", len(entries))
+			}
+			if entries[0].Status != tt.wantStatus {
+				t.Errorf("logged status = %d, want %d", entries[0].Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMappedIPv4Address(t *testing.T) {
+	setupTest(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/check", nil)
+	r.RemoteAddr = "[::ffff:1.2.3.4]:40000"
+	clientIP := getClientIP(r)
+	if clientIP != "1.2.3.4" {
+		t.Fatalf("client IP = %q, want 1.2.3.4", clientIP)
+	}
+	if v := getIPVersion(net.ParseIP(clientIP)); v != 4 {
+		t.Errorf("IP version = %d, want 4", v)
+	}
+
+	tests := []struct{ in, normalized, anonymized string }{
+		{"::ffff:1.2.3.4", "1.2.3.4", "1.2.3.0"},
+		{"1.2.3.4", "1.2.3.4", "1.2.3.0"},
+		{"2001:db8::1", "2001:db8::1", "2001:db8::"},
+	}
+	for _, tt := range tests {
+		if got := normalizeIP(tt.in); got != tt.normalized {
+			t.Errorf("normalizeIP(%q) = %q, want %q", tt.in, got, tt.normalized)
+		}
+		if got := anonymizeIP(tt.in); got != tt.anonymized {
+			t.Errorf("anonymizeIP(%q) = %q, want %q", tt.in, got, tt.anonymized)
+		}
+	}
+
+	// A mapped address is dialed as a plain IPv4 address
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	host := normalizeIP("::ffff:127.0.0.1")
+	if got, want := formatHostPort(host, port), "127.0.0.1:"+strconv.Itoa(port); got != want {
+		t.Errorf("formatHostPort = %q, want %q", got, want)
+	}
+	conn, _, err := dialPort(context.Background(), host, port)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", host, err)
+	}
+	conn.Close()
+}
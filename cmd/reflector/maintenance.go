@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Maintenance mode short-circuits all check endpoints with 503
+var maintenance atomic.Bool
+
+type MaintenanceResponse struct {
+	Success     bool   `json:"success"`
+	Maintenance bool   `json:"maintenance"`
+	Timestamp   string `json:"timestamp"`
+	Error       string `json:"error,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// setMaintenance switches maintenance mode and logs the change
+func setMaintenance(enabled bool, source string) {
+	if maintenance.Swap(enabled) == enabled {
+		return
+	}
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	log.Printf("Maintenance mode %s (%s)", state, source)
+	logger.LogError("info", "maintenance mode changed", map[string]interface{}{
+		"maintenance": enabled,
+		"source":      source,
+	})
+}
+
+// watchMaintenanceSignal toggles maintenance mode on every SIGUSR1
+func watchMaintenanceSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	go func() {
+		for range sigChan {
+			setMaintenance(!maintenance.Load(), "SIGUSR1")
+		}
+	}()
+}
+
+// setRetryAfter sets the Retry-After header for maintenance responses
+func setRetryAfter(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(config.MaintenanceRetryAfter.Seconds())))
+}
+
+// handleAdminMaintenance reports (GET) or changes (POST ?enabled=true|false)
+// the maintenance state. It requires an admin API key.
+func handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	reply := func(status int, resp MaintenanceResponse) {
+		resp.Maintenance = maintenance.Load()
+		resp.Timestamp = formatTimestamp(time.Now())
+		w.WriteHeader(status)
+		encodeResponse(json.NewEncoder(w), resp)
+	}
+
+	key, err := authenticate(r)
+	if err != nil || key == nil || !key.Admin {
+		reply(http.StatusUnauthorized, MaintenanceResponse{
+			Error:   "unauthorized",
+			Message: "An admin API key is required",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		reply(http.StatusOK, MaintenanceResponse{Success: true})
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			reply(http.StatusBadRequest, MaintenanceResponse{
+				Error:   "invalid_enabled",
+				Message: "enabled must be true or false",
+			})
+			return
+		}
+		setMaintenance(enabled, "admin:"+key.Name)
+		reply(http.StatusOK, MaintenanceResponse{Success: true})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		reply(http.StatusMethodNotAllowed, MaintenanceResponse{
+			Error:   "method_not_allowed",
+			Message: "Use GET or POST",
+		})
+	}
+}
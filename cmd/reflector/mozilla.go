@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/x509"
+	_ "embed"
+	"sync"
+)
+
+// mozillaRootsPEM is the Mozilla CA root store, which browsers either use
+// directly or closely follow. Refresh it from a current ca-certificates or
+// https://curl.se/ca/cacert.pem when updating dependencies.
+//
+//go:embed mozilla_roots.pem
+var mozillaRootsPEM []byte
+
+// mozillaRoots is the pool chains are verified against for mozilla_trust,
+// independent of the root store of the host the reflector runs on
+var mozillaRoots = sync.OnceValue(func() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(mozillaRootsPEM)
+	return pool
+})
+
+// verifyMozillaTrust reports whether cert chains up to a Mozilla root
+// through the intermediates the server presented
+func verifyMozillaTrust(cert *x509.Certificate, verifyOpts x509.VerifyOptions) bool {
+	verifyOpts.Roots = mozillaRoots()
+	_, err := cert.Verify(verifyOpts)
+	return err == nil
+}
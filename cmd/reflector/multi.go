@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of peers queried at the same time by /check/multi
+const maxPeerFanout = 4
+
+// Upper bound for a peer's /check response body
+const maxPeerResponseBytes = 1 << 20
+
+// Peer is another reflector that /check/multi asks for its view
+type Peer struct {
+	Region string
+	URL    *url.URL
+}
+
+// VantageResult is the outcome of the check from one peer
+type VantageResult struct {
+	Region     string         `json:"region"`
+	Status     int            `json:"status,omitempty"` // HTTP status of the peer's answer
+	DurationMs int64          `json:"duration_ms"`
+	Check      *CheckResponse `json:"check,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// VantageSummary lists the regions a port was (not) reachable from
+type VantageSummary struct {
+	ReachableFrom   []string `json:"reachable_from"`
+	UnreachableFrom []string `json:"unreachable_from"`
+}
+
+type MultiCheckResponse struct {
+	Success   bool                       `json:"success"`
+	ClientIP  string                     `json:"client_ip"`
+	Timestamp string                     `json:"timestamp"`
+	Vantages  []VantageResult            `json:"vantages,omitempty"`
+	Ports     map[string]*VantageSummary `json:"ports,omitempty"`
+	Error     string                     `json:"error,omitempty"`
+	Message   string                     `json:"message,omitempty"`
+}
+
+// parsePeers parses REFLECTOR_PEERS, a JSON object mapping region labels to
+// base URLs, e.g. {"eu-west":"https://eu.example.com"}. Peers are returned
+// sorted by region so responses list them in a stable order.
+func parsePeers(s string) ([]Peer, error) {
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, err
+	}
+	peers := make([]Peer, 0, len(raw))
+	for region, rawURL := range raw {
+		if region == "" {
+			return nil, fmt.Errorf("empty region label")
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("region %s: invalid URL %q", region, rawURL)
+		}
+		peers = append(peers, Peer{Region: region, URL: u})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Region < peers[j].Region })
+	return peers, nil
+}
+
+// Parameters that are not passed on to peers: secrets of this reflector
+// and options that would change the shape of the peer's response
+var peerStrippedParams = []string{"api_key", "pretty", "format", "results"}
+
+var peerClient = &http.Client{
+	// Peers answer directly; redirects are not followed
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// queryPeer runs the check on peer for clientIP. The peer sees clientIP in
+// X-Forwarded-For and only honors it if this reflector is one of its
+// REFLECTOR_TRUSTED_PROXIES.
+func queryPeer(ctx context.Context, peer Peer, clientIP string, r *http.Request) (result VantageResult) {
+	start := time.Now()
+	result.Region = peer.Region
+	defer func() { result.DurationMs = time.Since(start).Milliseconds() }()
+
+	query := r.URL.Query()
+	for _, param := range peerStrippedParams {
+		query.Del(param)
+	}
+	target := peer.URL.JoinPath("check")
+	target.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, config.PeerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		result.Error = "peer_unreachable"
+		return result
+	}
+	req.Header.Set("User-Agent", config.UserAgent)
+	req.Header.Set("X-Forwarded-For", clientIP)
+	if timeout := r.Header.Get("X-Check-Timeout"); timeout != "" {
+		req.Header.Set("X-Check-Timeout", timeout)
+	}
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		result.Error = "peer_unreachable"
+		return result
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+
+	var check CheckResponse
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxPeerResponseBytes)).Decode(&check); err != nil {
+		result.Error = "peer_invalid_response"
+		return result
+	}
+	result.Check = &check
+	return result
+}
+
+// summarizeVantages groups the regions by whether they reached each port
+func summarizeVantages(vantages []VantageResult) map[string]*VantageSummary {
+	summary := make(map[string]*VantageSummary)
+	for _, vantage := range vantages {
+		if vantage.Check == nil {
+			continue
+		}
+		for port, result := range vantage.Check.Results {
+			s, ok := summary[port]
+			if !ok {
+				s = &VantageSummary{ReachableFrom: []string{}, UnreachableFrom: []string{}}
+				summary[port] = s
+			}
+			if result.Reachable {
+				s.ReachableFrom = append(s.ReachableFrom, vantage.Region)
+			} else {
+				s.UnreachableFrom = append(s.UnreachableFrom, vantage.Region)
+			}
+		}
+	}
+	return summary
+}
+
+// handleCheckMulti fans the check out to the configured peers and reports
+// which of them could reach the caller
+func handleCheckMulti(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	clientIP := getClientIP(r)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	reply := func(status int, resp MultiCheckResponse) {
+		if !config.RedactFields["client_ip"] {
+			resp.ClientIP = clientIP
+		}
+		resp.Timestamp = formatTimestamp(time.Now())
+		w.WriteHeader(status)
+		enc := json.NewEncoder(w)
+		if r.URL.Query().Get("pretty") == "true" {
+			enc.SetIndent("", "  ")
+		}
+		encodeResponse(enc, resp)
+		logger.LogAccess(AccessLogEntry{
+			Timestamp:  resp.Timestamp,
+			IP:         clientIP,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			DurationMs: time.Since(start).Milliseconds(),
+			Status:     status,
+			Error:      resp.Error,
+			Scheme:     requestScheme(r),
+			Query:      loggedQuery(r),
+		})
+	}
+
+	if len(config.Peers) == 0 {
+		reply(http.StatusNotFound, MultiCheckResponse{
+			Error:   "multi_disabled",
+			Message: "No peer reflectors are configured on this server",
+		})
+		return
+	}
+
+	if maintenance.Load() {
+		setRetryAfter(w)
+		reply(http.StatusServiceUnavailable, MultiCheckResponse{
+			Error:   "maintenance",
+			Message: config.MaintenanceMessage,
+		})
+		return
+	}
+
+	if !rateLimitExempt(r) && !rateLimiter.GetLimiter(clientIP).Allow() {
+		reply(http.StatusTooManyRequests, MultiCheckResponse{
+			Error:   "rate_limit_exceeded",
+			Message: "Too many requests. Please try again later.",
+		})
+		return
+	}
+
+	apiKey, err := authenticate(r)
+	if err != nil {
+		reply(http.StatusUnauthorized, MultiCheckResponse{
+			Error:   "invalid_api_key",
+			Message: "The supplied API key is not valid",
+		})
+		return
+	}
+	if !checkQuota(w, apiKey) {
+		reply(http.StatusTooManyRequests, MultiCheckResponse{
+			Error:   "quota_exceeded",
+			Message: "Daily quota for this API key exhausted. Please try again later.",
+		})
+		return
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		reply(http.StatusBadRequest, MultiCheckResponse{
+			Error:   "invalid_ip",
+			Message: "Could not determine client IP",
+		})
+		return
+	}
+	if matchedRange, private := matchPrivateRange(ip); private {
+		reply(http.StatusForbidden, MultiCheckResponse{
+			Error:   "private_ip",
+			Message: fmt.Sprintf("Cannot test private/internal IP addresses (%s)", matchedRange),
+		})
+		return
+	}
+
+	vantages := make([]VantageResult, len(config.Peers))
+	slots := make(chan struct{}, maxPeerFanout)
+	var wg sync.WaitGroup
+	for i, peer := range config.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			vantages[i] = queryPeer(r.Context(), peer, clientIP, r)
+		}()
+	}
+	wg.Wait()
+
+	answered := 0
+	for _, vantage := range vantages {
+		if vantage.Check != nil {
+			answered++
+		}
+	}
+	resp := MultiCheckResponse{
+		Success:  answered > 0,
+		Vantages: vantages,
+		Ports:    summarizeVantages(vantages),
+	}
+	if answered == 0 {
+		resp.Error = "no_vantage_answered"
+		resp.Message = "None of the " + strconv.Itoa(len(vantages)) + " peer reflectors answered"
+		reply(http.StatusBadGateway, resp)
+		return
+	}
+	if answered < len(vantages) {
+		regions := make([]string, 0, len(vantages)-answered)
+		for _, vantage := range vantages {
+			if vantage.Check == nil {
+				regions = append(regions, vantage.Region)
+			}
+		}
+		resp.Message = "No answer from: " + strings.Join(regions, ", ")
+	}
+	reply(http.StatusOK, resp)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type NotFoundResponse struct {
+	Success   bool   `json:"success"`
+	Path      string `json:"path"`
+	Timestamp string `json:"timestamp"`
+	Error     string `json:"error"`
+	Message   string `json:"message,omitempty"`
+}
+
+// handleNotFound is registered as "/" so it only receives paths no other
+// route matched, and answers them with the usual JSON error envelope
+// instead of the mux's plain-text 404
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusNotFound)
+	encodeResponse(json.NewEncoder(w), NotFoundResponse{
+		Success:   false,
+		Path:      r.URL.Path,
+		Timestamp: formatTimestamp(time.Now()),
+		Error:     "not_found",
+		Message:   config.NotFoundMessage,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// CheckOptions are the on/off features of a /check request. Each can be set
+// with its own parameter (banner=true) or listed in opts (opts=banner,ptr).
+type CheckOptions struct {
+	TLSAnalyze       bool
+	TLSResumption    bool
+	ChainPEM         bool
+	MozillaTrust     bool
+	HTTPSCheck       bool
+	HTTPSRedirect    bool
+	Banner           bool
+	Services         bool
+	PTR              bool
+	DetectReset      bool
+	DetectHTTP       bool
+	HTTPOptions      bool
+	Keepalive        bool
+	LargePacket      bool
+	SMTPCheck        bool
+	TFO              bool
+	LocalAddr        bool
+	TCPInfo          bool
+	Traceroute       bool
+	ChallengeAddPort bool
+}
+
+// checkOptionFields maps option names, which equal the parameter names, to
+// their field in CheckOptions
+var checkOptionFields = map[string]func(*CheckOptions) *bool{
+	"tls_analyze":        func(o *CheckOptions) *bool { return &o.TLSAnalyze },
+	"tls_resumption":     func(o *CheckOptions) *bool { return &o.TLSResumption },
+	"chain_pem":          func(o *CheckOptions) *bool { return &o.ChainPEM },
+	"mozilla_trust":      func(o *CheckOptions) *bool { return &o.MozillaTrust },
+	"https_check":        func(o *CheckOptions) *bool { return &o.HTTPSCheck },
+	"https_redirect":     func(o *CheckOptions) *bool { return &o.HTTPSRedirect },
+	"banner":             func(o *CheckOptions) *bool { return &o.Banner },
+	"services":           func(o *CheckOptions) *bool { return &o.Services },
+	"ptr":                func(o *CheckOptions) *bool { return &o.PTR },
+	"detect_reset":       func(o *CheckOptions) *bool { return &o.DetectReset },
+	"detect_http":        func(o *CheckOptions) *bool { return &o.DetectHTTP },
+	"http_options":       func(o *CheckOptions) *bool { return &o.HTTPOptions },
+	"keepalive":          func(o *CheckOptions) *bool { return &o.Keepalive },
+	"large_packet":       func(o *CheckOptions) *bool { return &o.LargePacket },
+	"smtp_check":         func(o *CheckOptions) *bool { return &o.SMTPCheck },
+	"tfo":                func(o *CheckOptions) *bool { return &o.TFO },
+	"local_addr":         func(o *CheckOptions) *bool { return &o.LocalAddr },
+	"tcp_info":           func(o *CheckOptions) *bool { return &o.TCPInfo },
+	"traceroute":         func(o *CheckOptions) *bool { return &o.Traceroute },
+	"challenge_add_port": func(o *CheckOptions) *bool { return &o.ChallengeAddPort },
+}
+
+// Short names accepted in opts
+var checkOptionAliases = map[string]string{
+	"tls": "tls_analyze",
+}
+
+// parseCheckOptions reads the individual parameters and then switches on
+// everything listed in opts. tls_analyze is the only option that is on by
+// default; it can only be turned off with tls_analyze=false.
+func parseCheckOptions(query url.Values) (CheckOptions, error) {
+	var options CheckOptions
+	for name, field := range checkOptionFields {
+		*field(&options) = query.Get(name) == "true"
+	}
+	options.TLSAnalyze = query.Get("tls_analyze") != "false"
+
+	if list := query.Get("opts"); list != "" {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if alias, ok := checkOptionAliases[name]; ok {
+				name = alias
+			}
+			field, ok := checkOptionFields[name]
+			if !ok {
+				return options, fmt.Errorf("unknown option: %q", name)
+			}
+			*field(&options) = true
+		}
+	}
+
+	// https_check builds on the TLS analysis, so it turns it back on
+	if options.HTTPSCheck {
+		options.TLSAnalyze = true
+	}
+	return options, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer is what outbound probes dial with: a plain net.Dialer, or one that
+// tunnels through REFLECTOR_UPSTREAM_PROXY
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// upstreamDialer wraps forward so that every connection is tunneled
+// through the proxy at u (http:// via CONNECT, or socks5://). Each dial,
+// including the proxy handshake, is bounded by timeout.
+type upstreamDialer struct {
+	timeout time.Duration
+	dialer  proxy.ContextDialer
+}
+
+// The dialer for REFLECTOR_UPSTREAM_PROXY, built once at startup; nil when
+// connections are made directly
+var upstreamProxy *upstreamDialer
+
+// withTimeout returns a dialer sharing d's proxy connection settings that
+// bounds each dial by timeout instead
+func (d *upstreamDialer) withTimeout(timeout time.Duration) *upstreamDialer {
+	return &upstreamDialer{timeout: timeout, dialer: d.dialer}
+}
+
+func newUpstreamDialer(u *url.URL, forward *net.Dialer) (*upstreamDialer, error) {
+	d, err := proxy.FromURL(u, forward)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy scheme %s does not support contexts", u.Scheme)
+	}
+	return &upstreamDialer{timeout: forward.Timeout, dialer: contextDialer}, nil
+}
+
+func (d *upstreamDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *upstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*tunnelConn); ok {
+		return tc, nil
+	}
+	// Report the target, not the proxy, as remote address so follow-up
+	// probes (e.g. TLS resumption) reconnect to the right place
+	return &tunnelConn{Conn: conn, remote: tunnelAddr(address)}, nil
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tcp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnelConn is a connection through the upstream proxy. Reads are served
+// from r first, which may hold bytes the target sent right after CONNECT.
+type tunnelConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	if c.r != nil {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy using CONNECT
+type httpConnectDialer struct {
+	proxyAddr string
+	auth      string
+	forward   proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &httpConnectDialer{proxyAddr: u.Host, forward: forward}
+	if u.Port() == "" {
+		d.proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	}
+	return d, nil
+}
+
+func (d *httpConnectDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if cd, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, "tcp", d.proxyAddr)
+	} else {
+		conn, err = d.forward.Dial("tcp", d.proxyAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", address, resp.Status)
+	}
+
+	return &tunnelConn{Conn: conn, r: r, remote: tunnelAddr(address)}, nil
+}
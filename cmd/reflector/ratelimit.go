@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter decides whether a single request may proceed
+type Limiter interface {
+	Allow() bool
+}
+
+// Rate-limit algorithms selectable via REFLECTOR_RATE_LIMIT_ALGORITHM
+var rateLimitAlgorithms = map[string]func(limit int, window time.Duration) Limiter{
+	// Token bucket: limit requests as burst, refilled evenly over window
+	"token": func(limit int, window time.Duration) Limiter {
+		return rate.NewLimiter(rate.Every(window/time.Duration(limit)), limit)
+	},
+	"sliding": newSlidingWindowLimiter,
+	"fixed":   newFixedWindowLimiter,
+}
+
+func parseRateLimitAlgorithm(s string) (string, error) {
+	if _, ok := rateLimitAlgorithms[s]; !ok {
+		return "", fmt.Errorf("unknown algorithm %q (use token, sliding or fixed)", s)
+	}
+	return s, nil
+}
+
+func newLimiter(limit int, window time.Duration) Limiter {
+	return rateLimitAlgorithms[config.RateLimitAlgorithm](limit, window)
+}
+
+// fixedWindowLimiter allows limit requests per calendar window (e.g. per
+// wall-clock minute) and resets at the window boundary
+type fixedWindowLimiter struct {
+	limit  int
+	window time.Duration
+	start  time.Time
+	count  int
+	mu     sync.Mutex
+}
+
+func newFixedWindowLimiter(limit int, window time.Duration) Limiter {
+	return &fixedWindowLimiter{limit: limit, window: window}
+}
+
+func (l *fixedWindowLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if start := time.Now().Truncate(l.window); !start.Equal(l.start) {
+		l.start, l.count = start, 0
+	}
+	if l.count >= l.limit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// slidingWindowLimiter allows at most limit requests in any window-long
+// interval by remembering the times of the last limit requests
+type slidingWindowLimiter struct {
+	limit  int
+	window time.Duration
+	times  []time.Time // oldest first
+	mu     sync.Mutex
+}
+
+func newSlidingWindowLimiter(limit int, window time.Duration) Limiter {
+	return &slidingWindowLimiter{limit: limit, window: window}
+}
+
+func (l *slidingWindowLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+	expired := 0
+	for expired < len(l.times) && !l.times[expired].After(cutoff) {
+		expired++
+	}
+	l.times = l.times[expired:]
+
+	if len(l.times) >= l.limit {
+		return false
+	}
+	l.times = append(l.times, now)
+	return true
+}
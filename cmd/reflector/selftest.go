@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Name looked up to test the resolver
+const selfTestLookupName = "example.com"
+
+// SelfTestCheck is one dependency tested at startup. A failing critical
+// check stops the reflector; other failures are only reported.
+type SelfTestCheck struct {
+	Name       string `json:"name"`
+	Critical   bool   `json:"critical"`
+	OK         bool   `json:"ok"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SelfTestReport is the outcome of runSelfTest
+type SelfTestReport struct {
+	OK     bool            `json:"ok"` // all critical checks passed
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// runSelfTest verifies what the reflector depends on: that the log
+// directory is writable, that outbound dials work (both critical) and that
+// the resolver answers, which only hostname targets need
+func runSelfTest() SelfTestReport {
+	report := SelfTestReport{OK: true}
+	run := func(name string, critical bool, test func() error) {
+		start := time.Now()
+		err := test()
+		check := SelfTestCheck{
+			Name:       name,
+			Critical:   critical,
+			OK:         err == nil,
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			check.Error = err.Error()
+			if critical {
+				report.OK = false
+			}
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	run("log_dir_writable", true, func() error {
+		f, err := os.CreateTemp(config.LogDir, ".selftest-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.WriteString("ok\n"); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+
+	run("outbound_dial", true, func() error {
+		conn, err := newDialer(config.Timeout).Dial("tcp", config.SelfTestTarget)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+
+	run("resolver", false, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+		defer cancel()
+		_, err := resolver.LookupHost(ctx, selfTestLookupName)
+		return err
+	})
+
+	return report
+}
+
+// selfTestOrExit runs the self-test, writes the report to the error log and
+// the console, and exits if a critical check failed
+func selfTestOrExit() {
+	report := runSelfTest()
+
+	level := "info"
+	var failed []string
+	for _, check := range report.Checks {
+		if check.OK {
+			continue
+		}
+		level = "warn"
+		if check.Critical {
+			failed = append(failed, check.Name)
+		} else {
+			log.Printf("Warning: self-test %s failed: %s", check.Name, check.Error)
+		}
+	}
+	if len(failed) > 0 {
+		level = "error"
+	}
+	logger.LogError(level, "self-test", map[string]interface{}{"self_test": report})
+	if b, err := json.Marshal(report); err == nil {
+		log.Printf("Self-test: %s", b)
+	}
+	if len(failed) > 0 {
+		log.Fatalf("Self-test failed: %s", strings.Join(failed, ", "))
+	}
+}
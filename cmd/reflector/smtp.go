@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SMTPResult reports how far an SMTP session with the client's port 25 got:
+// greeting, EHLO, whether STARTTLS is offered and the TLS it then negotiates
+type SMTPResult struct {
+	Greeting   string   `json:"greeting,omitempty"`
+	EHLO       bool     `json:"ehlo"`
+	Extensions []string `json:"extensions,omitempty"`
+	StartTLS   bool     `json:"starttls"` // advertised in the EHLO response
+	TLS        *TLSInfo `json:"tls,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// checkSMTP walks through the steps a sending mail server takes on host:25.
+// After a successful STARTTLS the connection is upgraded and analyzed like
+// port 443, without session resumption, which would need a second session.
+func checkSMTP(host string, opts TLSProbeOptions) *SMTPResult {
+	result := &SMTPResult{}
+
+	conn, err := newDialer(config.Timeout).Dial("tcp", formatHostPort(host, 25))
+	if err != nil {
+		result.Error = "connection_failed"
+		return result
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+	text := textproto.NewConn(conn)
+
+	_, greeting, err := text.ReadResponse(220)
+	if err != nil {
+		result.Error = "smtp_no_greeting"
+		return result
+	}
+	firstLine, _, _ := strings.Cut(greeting, "\n")
+	result.Greeting = sanitizeBanner(firstLine)
+
+	if err := text.PrintfLine("EHLO %s", config.SMTPHelloName); err != nil {
+		result.Error = "smtp_ehlo_failed"
+		return result
+	}
+	_, ehlo, err := text.ReadResponse(250)
+	if err != nil {
+		result.Error = "smtp_ehlo_failed"
+		return result
+	}
+	result.EHLO = true
+	// The first line is the server's greeting, the others its extensions
+	lines := strings.Split(ehlo, "\n")
+	for _, line := range lines[1:] {
+		extension := strings.ToUpper(strings.TrimSpace(line))
+		if extension == "" {
+			continue
+		}
+		result.Extensions = append(result.Extensions, extension)
+		if keyword, _, _ := strings.Cut(extension, " "); keyword == "STARTTLS" {
+			result.StartTLS = true
+		}
+	}
+
+	if !result.StartTLS {
+		text.PrintfLine("QUIT")
+		return result
+	}
+
+	if err := text.PrintfLine("STARTTLS"); err != nil {
+		result.Error = "smtp_starttls_failed"
+		return result
+	}
+	if _, _, err := text.ReadResponse(220); err != nil {
+		result.Error = "smtp_starttls_failed"
+		return result
+	}
+
+	opts.Resumption = false
+	tlsInfo, err := analyzeTLS(conn, opts)
+	if err != nil {
+		result.Error = "smtp_tls_failed"
+		return result
+	}
+	result.TLS = tlsInfo
+	return result
+}
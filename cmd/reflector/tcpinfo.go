@@ -0,0 +1,27 @@
+package main
+
+import "net"
+
+// TCPConnInfo is what the kernel knows about an established connection
+// (Linux TCP_INFO). Times are in microseconds.
+type TCPConnInfo struct {
+	RTTUs       uint32   `json:"rtt_us"`
+	RTTVarUs    uint32   `json:"rttvar_us"`
+	MinRTTUs    uint32   `json:"min_rtt_us,omitempty"`
+	SndCwnd     uint32   `json:"snd_cwnd"` // congestion window in segments
+	SndMSS      uint32   `json:"snd_mss"`
+	RcvMSS      uint32   `json:"rcv_mss"`
+	PMTU        uint32   `json:"pmtu,omitempty"`
+	Retransmits uint32   `json:"total_retrans"`
+	Options     []string `json:"options,omitempty"` // negotiated TCP options
+}
+
+// tcpConnInfo returns the TCP details of conn, or nil where the platform
+// does not expose them or conn is tunneled through an upstream proxy
+func tcpConnInfo(conn net.Conn) *TCPConnInfo {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return readTCPInfo(tcpConn)
+}
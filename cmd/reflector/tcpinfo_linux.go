@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCPI_OPT_* bits of tcpi_options
+var tcpInfoOptions = []struct {
+	bit  uint8
+	name string
+}{
+	{0x01, "timestamps"},
+	{0x02, "sack"},
+	{0x04, "window_scale"},
+	{0x08, "ecn"},
+	{0x10, "ecn_seen"},
+	{0x20, "syn_data"},
+}
+
+func readTCPInfo(conn *net.TCPConn) *TCPConnInfo {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var info *unix.TCPInfo
+	var infoErr error
+	if err := raw.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil || infoErr != nil {
+		return nil
+	}
+
+	result := &TCPConnInfo{
+		RTTUs:       info.Rtt,
+		RTTVarUs:    info.Rttvar,
+		MinRTTUs:    info.Min_rtt,
+		SndCwnd:     info.Snd_cwnd,
+		SndMSS:      info.Snd_mss,
+		RcvMSS:      info.Rcv_mss,
+		PMTU:        info.Pmtu,
+		Retransmits: info.Total_retrans,
+	}
+	for _, option := range tcpInfoOptions {
+		if info.Options&option.bit != 0 {
+			result.Options = append(result.Options, option.name)
+		}
+	}
+	return result
+}
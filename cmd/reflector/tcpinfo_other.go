@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// readTCPInfo is only implemented on Linux
+func readTCPInfo(conn *net.TCPConn) *TCPConnInfo {
+	return nil
+}
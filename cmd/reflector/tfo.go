@@ -0,0 +1,22 @@
+package main
+
+// probeTFO reports whether a connection to host:port attempted TCP Fast Open
+// and whether the client accepted data in the SYN. The first connection asks
+// for a cookie, the second sends its request along with the SYN. Where the OS
+// or an upstream proxy gets in the way, both are false. The request is a
+// HEAD, so only plain HTTP ports are probed; other services would receive
+// a protocol violation.
+func probeTFO(host string, port int) (attempted, accepted bool) {
+	if config.UpstreamProxy != nil || httpScheme(port) != "http" {
+		return false, false
+	}
+	addr := formatHostPort(host, port)
+	for round := 0; round < 2; round++ {
+		ok, synData := tfoConnect(addr)
+		if !ok {
+			return attempted, false
+		}
+		attempted, accepted = true, synData
+	}
+	return attempted, accepted
+}
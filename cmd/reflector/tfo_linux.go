@@ -0,0 +1,69 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tcpStateEstablished = 1    // TCP_ESTABLISHED
+	tcpiOptSynData      = 0x20 // TCPI_OPT_SYN_DATA: data in our SYN was acked
+)
+
+// tfoConnect connects to addr with TCP_FASTOPEN_CONNECT, which defers the
+// handshake until the first write so the request can ride in the SYN. It
+// reports whether the socket option could be set and the connection came up,
+// and whether the peer acknowledged the SYN data.
+func tfoConnect(addr string) (bool, bool) {
+	var optErr error
+	dialer := &net.Dialer{
+		Timeout:  config.Timeout,
+		Resolver: resolver,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := c.Control(func(fd uintptr) {
+				optErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+			}); err != nil {
+				return err
+			}
+			return optErr
+		},
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return false, false
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(config.Timeout)
+	conn.SetDeadline(deadline)
+	if _, err := fmt.Fprintf(conn, "HEAD / HTTP/1.0\r\nUser-Agent: %s\r\n\r\n", config.UserAgent); err != nil {
+		return false, false
+	}
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	for {
+		var info *unix.TCPInfo
+		var infoErr error
+		if err := raw.Control(func(fd uintptr) {
+			info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		}); err != nil || infoErr != nil {
+			return false, false
+		}
+		if info.State == tcpStateEstablished {
+			return true, info.Options&tcpiOptSynData != 0
+		}
+		if time.Now().After(deadline) {
+			return false, false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
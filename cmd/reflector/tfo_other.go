@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// tfoConnect is only implemented on Linux
+func tfoConnect(addr string) (bool, bool) {
+	return false, false
+}
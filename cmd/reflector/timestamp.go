@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// Zone names work without tzdata in the image (alpine has none)
+	_ "time/tzdata"
+)
+
+// Timestamp formats that are not Go layouts
+var namedTimestampFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"epoch":       "",
+	"epoch_ms":    "",
+}
+
+// parseTimestampFormat accepts one of namedTimestampFormats or a Go time
+// layout such as "2006-01-02 15:04:05". A layout that formats to itself
+// contains no reference element and is rejected as a likely typo.
+func parseTimestampFormat(s string) (string, error) {
+	if _, ok := namedTimestampFormats[strings.ToLower(s)]; ok {
+		return strings.ToLower(s), nil
+	}
+	if time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Format(s) == s {
+		return "", fmt.Errorf("%q is neither a known format nor a Go time layout", s)
+	}
+	return s, nil
+}
+
+// formatTimestamp renders t for responses and logs in the configured format
+// (REFLECTOR_TIMESTAMP_FORMAT) and time zone (REFLECTOR_TIMESTAMP_TIMEZONE).
+// Epoch formats are written as decimal strings so fields keep their type.
+func formatTimestamp(t time.Time) string {
+	switch config.TimestampFormat {
+	case "epoch":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "epoch_ms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	layout := config.TimestampFormat
+	if named, ok := namedTimestampFormats[layout]; ok {
+		layout = named
+	}
+	return t.In(config.TimestampLocation).Format(layout)
+}
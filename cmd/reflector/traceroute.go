@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Traceroute limits
+const (
+	tracerouteMaxHops   = 30
+	tracerouteHopWait   = time.Second
+	tracerouteTimeout   = 10 * time.Second
+	tracerouteFirstPort = 33434 // classic traceroute base port
+)
+
+// TracerouteHop is one router on the path back to the client. IP is empty
+// when the hop did not answer in time.
+type TracerouteHop struct {
+	TTL   int    `json:"ttl"`
+	IP    string `json:"ip,omitempty"`
+	RTTMs int64  `json:"rtt_ms,omitempty"`
+}
+
+// TracerouteResult is the path from the reflector back to the client
+type TracerouteResult struct {
+	Hops    []TracerouteHop `json:"hops,omitempty"`
+	Reached bool            `json:"reached"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// traceroute sends UDP probes with increasing TTL to ip and collects the
+// ICMP time-exceeded replies of the routers in between. Reading ICMP needs a
+// raw socket (CAP_NET_RAW); without it the result only carries an error.
+// The probes cannot go through an upstream proxy, so with one configured
+// there is no traceroute either.
+func traceroute(ctx context.Context, ip net.IP) *TracerouteResult {
+	if config.UpstreamProxy != nil {
+		return &TracerouteResult{Error: "traceroute_unavailable"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, tracerouteTimeout)
+	defer cancel()
+
+	v4 := ip.To4() != nil
+	network, icmpAddr, icmpProto := "ip6:ipv6-icmp", "::", 58
+	if v4 {
+		network, icmpAddr, icmpProto = "ip4:icmp", "0.0.0.0", 1
+	}
+	icmpConn, err := icmp.ListenPacket(network, icmpAddr)
+	if err != nil {
+		return &TracerouteResult{Error: "traceroute_unavailable"}
+	}
+	defer icmpConn.Close()
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return &TracerouteResult{Error: "traceroute_unavailable"}
+	}
+	defer udpConn.Close()
+	localPort := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	setTTL := func(ttl int) error { return ipv6.NewPacketConn(udpConn).SetHopLimit(ttl) }
+	if v4 {
+		setTTL = func(ttl int) error { return ipv4.NewPacketConn(udpConn).SetTTL(ttl) }
+	}
+
+	result := &TracerouteResult{}
+	buf := make([]byte, 1500)
+	for ttl := 1; ttl <= tracerouteMaxHops && ctx.Err() == nil; ttl++ {
+		if err := setTTL(ttl); err != nil {
+			result.Error = "traceroute_unavailable"
+			return result
+		}
+		dst := &net.UDPAddr{IP: ip, Port: tracerouteFirstPort + ttl}
+		sent := time.Now()
+		if _, err := udpConn.WriteTo([]byte("reflector"), dst); err != nil {
+			result.Error = "traceroute_failed"
+			return result
+		}
+
+		hop := TracerouteHop{TTL: ttl}
+		deadline := sent.Add(tracerouteHopWait)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		icmpConn.SetReadDeadline(deadline)
+		for {
+			n, peer, err := icmpConn.ReadFrom(buf)
+			if err != nil {
+				break // no answer for this hop
+			}
+			reached, ok := matchTracerouteReply(buf[:n], icmpProto, v4, localPort, dst.Port)
+			if !ok {
+				continue // reply to another probe
+			}
+			hop.IP = peer.String()
+			hop.RTTMs = time.Since(sent).Milliseconds()
+			result.Reached = reached
+			break
+		}
+		result.Hops = append(result.Hops, hop)
+		if result.Reached {
+			break
+		}
+	}
+	if ctx.Err() != nil && !result.Reached && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result.Error = "traceroute_timeout"
+	}
+	return result
+}
+
+// matchTracerouteReply checks whether an ICMP message answers our probe to
+// dstPort from srcPort. It reports whether the destination was reached
+// (port unreachable) as opposed to an intermediate hop (time exceeded).
+func matchTracerouteReply(b []byte, proto int, v4 bool, srcPort, dstPort int) (bool, bool) {
+	msg, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return false, false
+	}
+
+	var data []byte
+	reached := false
+	switch body := msg.Body.(type) {
+	case *icmp.TimeExceeded:
+		data = body.Data
+	case *icmp.DstUnreach:
+		data = body.Data
+		reached = true
+	default:
+		return false, false
+	}
+
+	// The quoted datagram starts with the original IP header followed by
+	// the UDP header (source port, destination port)
+	headerLen := ipv6.HeaderLen
+	if v4 {
+		if len(data) < 1 {
+			return false, false
+		}
+		headerLen = int(data[0]&0x0f) * 4
+	}
+	if len(data) < headerLen+4 {
+		return false, false
+	}
+	udp := data[headerLen:]
+	gotSrc := int(udp[0])<<8 | int(udp[1])
+	gotDst := int(udp[2])<<8 | int(udp[3])
+	if gotSrc != srcPort || gotDst != dstPort {
+		return false, false
+	}
+	return reached, true
+}